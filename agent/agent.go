@@ -0,0 +1,264 @@
+/*
+Package agent keeps private requests in memory, so that they never have to
+be written to disk while the requester waits for a response. The agent
+listens on a unix socket that only its owner can use, and decodes responses
+for its clients. Private keys never leave it.
+*/
+package agent
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Unquabain/ephemeral/data"
+	"github.com/apex/log"
+	"github.com/google/uuid"
+)
+
+// SocketVariable is the environment variable that tells clients where the
+// agent is listening.
+const SocketVariable = `EPHEMERAL_AGENT_SOCK`
+
+// DefaultSocket returns the socket named by SocketVariable, or else a
+// socket in a directory of the user's own.
+func DefaultSocket() string {
+	if path := os.Getenv(SocketVariable); path != `` {
+		return path
+	}
+	if dir := os.Getenv(`XDG_RUNTIME_DIR`); dir != `` {
+		return filepath.Join(dir, `ephemeral`, `agent.sock`)
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf(`ephemeral-%d`, os.Getuid()), `agent.sock`)
+}
+
+// ErrNoRequest is returned when the agent holds no request that a response
+// was made for.
+var ErrNoRequest = errors.New(`the agent holds no request for the response`)
+
+// Summary describes a request the agent holds.
+type Summary struct {
+	ID          uuid.UUID
+	Description string
+	Expires     time.Time
+}
+
+type entry struct {
+	request data.PrivateRequest
+	expires time.Time
+}
+
+// Agent holds private requests until they expire.
+type Agent struct {
+	mu      sync.Mutex
+	entries map[uuid.UUID]entry
+	ttl     time.Duration
+}
+
+// New creates an agent that keeps requests for no longer than ttl.
+func New(ttl time.Duration) *Agent {
+	return &Agent{
+		entries: make(map[uuid.UUID]entry),
+		ttl:     ttl,
+	}
+}
+
+// Add keeps a request until the TTL passes, or until it expires, if that is
+// sooner. It returns when the request will be forgotten.
+func (a *Agent) Add(request data.PrivateRequest) time.Time {
+	expires := time.Now().Add(a.ttl)
+	if !request.Expires.IsZero() && request.Expires.Before(expires) {
+		expires = request.Expires
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries[request.ID] = entry{request: request, expires: expires}
+	return expires
+}
+
+// find returns the request a response was made for, whether it was made
+// for the request itself, or for a group the request is a member of.
+func (a *Agent) find(response data.Response) (data.PrivateRequest, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire()
+	if e, ok := a.entries[response.ID]; ok {
+		return e.request, true
+	}
+	for _, recipient := range response.Recipients {
+		if e, ok := a.entries[recipient.ID]; ok {
+			return e.request, true
+		}
+	}
+	return data.PrivateRequest{}, false
+}
+
+// Decode decodes a response with the request it was made for. It also
+// returns the public part of that request.
+func (a *Agent) Decode(response data.Response) ([]byte, *data.Signer, data.PublicRequest, error) {
+	request, ok := a.find(response)
+	if !ok {
+		return nil, nil, data.PublicRequest{}, fmt.Errorf(`%w, which was made for request %s`, ErrNoRequest, response.ID)
+	}
+	secret, signer, err := request.DecodeSigned(response)
+	return secret, signer, request.Public(), err
+}
+
+// List describes the requests the agent holds.
+func (a *Agent) List() []Summary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire()
+	summaries := make([]Summary, 0, len(a.entries))
+	for id, e := range a.entries {
+		summaries = append(summaries, Summary{ID: id, Description: e.request.Description, Expires: e.expires})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Expires.Before(summaries[j].Expires)
+	})
+	return summaries
+}
+
+// expire forgets requests whose time is up. The lock must be held.
+func (a *Agent) expire() {
+	now := time.Now()
+	for id, e := range a.entries {
+		if now.After(e.expires) {
+			log.WithField(`request`, id).Info(`Forgetting expired request.`)
+			delete(a.entries, id)
+		}
+	}
+}
+
+// message is what a client sends to the agent. Exactly one of its fields
+// is set.
+type message struct {
+	Add    *data.PrivateRequest
+	Decode *data.Response
+	List   bool
+}
+
+// reply is what the agent sends back.
+type reply struct {
+	Error     string
+	NoRequest bool
+	Expires   time.Time
+	Secret    []byte
+	Signer    *data.Signer
+	Request   data.PublicRequest
+	List      []Summary
+}
+
+// checkDirectory makes sure that the socket's directory belongs to the
+// user, and that no one else can use it. Otherwise, another user could
+// have made it first, and be listening there for private requests.
+func checkDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf(`%s is not a directory`, dir)
+	}
+	if uid, ok := fileOwner(info); ok && uid != os.Getuid() {
+		return fmt.Errorf(`socket directory %s belongs to user %d`, dir, uid)
+	}
+	if info.Mode().Perm() != 0700 {
+		return fmt.Errorf(`socket directory %s has mode %#o, not 0700`, dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// Listen creates the socket at path. Its directory is created if need be,
+// and both can only be used by their owner.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf(`could not create socket directory: %w`, err)
+	}
+	if err := checkDirectory(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial(`unix`, path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf(`an agent is already listening on %s`, path)
+	}
+	os.Remove(path)
+	l, err := net.Listen(`unix`, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf(`could not restrict socket: %w`, err)
+	}
+	return l, nil
+}
+
+// Serve answers clients on l until it is closed. It also forgets expired
+// requests as they expire.
+func (a *Agent) Serve(l net.Listener) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				a.mu.Lock()
+				a.expire()
+				a.mu.Unlock()
+			}
+		}
+	}()
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *Agent) handle(conn net.Conn) {
+	defer conn.Close()
+	if err := checkPeer(conn); err != nil {
+		log.WithError(err).Warn(`Refusing client.`)
+		return
+	}
+	var (
+		m message
+		r reply
+	)
+	if err := gob.NewDecoder(conn).Decode(&m); err != nil {
+		log.WithError(err).Warn(`Could not read message.`)
+		return
+	}
+	switch {
+	case m.Add != nil:
+		r.Expires = a.Add(*m.Add)
+		log.WithField(`request`, m.Add.ID).WithField(`until`, r.Expires).Info(`Holding request.`)
+	case m.Decode != nil:
+		var err error
+		if r.Secret, r.Signer, r.Request, err = a.Decode(*m.Decode); err != nil {
+			r.Error = err.Error()
+			r.NoRequest = errors.Is(err, ErrNoRequest)
+		}
+	case m.List:
+		r.List = a.List()
+	default:
+		r.Error = `unknown message`
+	}
+	if err := gob.NewEncoder(conn).Encode(r); err != nil {
+		log.WithError(err).Warn(`Could not send reply.`)
+	}
+}
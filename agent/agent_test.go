@@ -0,0 +1,101 @@
+package agent_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Unquabain/ephemeral/agent"
+	"github.com/Unquabain/ephemeral/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func startAgent(t *testing.T, ttl time.Duration) agent.Client {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), `agent`, `agent.sock`)
+	l, err := agent.Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go agent.New(ttl).Serve(l)
+	return agent.Client{Socket: socket}
+}
+
+func TestAgent(t *testing.T) {
+	assert := assert.New(t)
+	client := startAgent(t, time.Hour)
+
+	request, err := data.NewRequest(`Launch codes`)
+	assert.NoError(err)
+	request.ExpireAfter(time.Minute)
+	until, err := client.Add(request)
+	assert.NoError(err)
+	assert.Equal(request.Expires, until, `the request expires before the TTL`)
+
+	list, err := client.List()
+	assert.NoError(err)
+	assert.Equal([]agent.Summary{{ID: request.ID, Description: `Launch codes`, Expires: until}}, list)
+
+	response, err := request.Public().Encode([]byte(`0000`))
+	assert.NoError(err)
+	secret, signer, public, err := client.Decode(response)
+	assert.NoError(err)
+	assert.Equal([]byte(`0000`), secret)
+	assert.Nil(signer)
+	assert.Equal(request.ID, public.ID)
+
+	// Group responses are found by their members.
+	other, err := data.NewRequest(``)
+	assert.NoError(err)
+	group, err := data.NewGroupRequest(``, other.Public(), request.Public())
+	assert.NoError(err)
+	response, err = group.Encode([]byte(`1234`))
+	assert.NoError(err)
+	secret, _, _, err = client.Decode(response)
+	assert.NoError(err)
+	assert.Equal([]byte(`1234`), secret)
+
+	response, err = other.Public().Encode([]byte(`0000`))
+	assert.NoError(err)
+	_, _, _, err = client.Decode(response)
+	assert.ErrorIs(err, agent.ErrNoRequest)
+
+	// A second agent cannot take over the socket.
+	_, err = agent.Listen(client.Socket)
+	assert.Error(err)
+}
+
+func TestAgentTTL(t *testing.T) {
+	assert := assert.New(t)
+	client := startAgent(t, time.Millisecond)
+
+	request, err := data.NewRequest(``)
+	assert.NoError(err)
+	_, err = client.Add(request)
+	assert.NoError(err)
+	time.Sleep(10 * time.Millisecond)
+
+	list, err := client.List()
+	assert.NoError(err)
+	assert.Empty(list)
+	response, err := request.Public().Encode([]byte(`0000`))
+	assert.NoError(err)
+	_, _, _, err = client.Decode(response)
+	assert.ErrorIs(err, agent.ErrNoRequest)
+}
+
+func TestSocketDirectory(t *testing.T) {
+	assert := assert.New(t)
+	// Another user could have made an open directory first, and be listening
+	// in it.
+	dir := filepath.Join(t.TempDir(), `open`)
+	assert.NoError(os.Mkdir(dir, 0700))
+	assert.NoError(os.Chmod(dir, 0755))
+	socket := filepath.Join(dir, `agent.sock`)
+	_, err := agent.Listen(socket)
+	assert.ErrorContains(err, `not 0700`)
+	_, err = agent.Client{Socket: socket}.List()
+	assert.ErrorContains(err, `will not trust the agent`)
+}
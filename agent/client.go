@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/Unquabain/ephemeral/data"
+)
+
+// Client talks to an agent over its socket.
+type Client struct {
+	Socket string
+}
+
+func (c Client) call(m message) (reply, error) {
+	var r reply
+	if err := checkDirectory(filepath.Dir(c.Socket)); err != nil {
+		return r, fmt.Errorf(`will not trust the agent at %s: %w`, c.Socket, err)
+	}
+	conn, err := net.Dial(`unix`, c.Socket)
+	if err != nil {
+		return r, fmt.Errorf(`could not reach the agent at %s: %w`, c.Socket, err)
+	}
+	defer conn.Close()
+	if err := checkPeer(conn); err != nil {
+		return r, fmt.Errorf(`will not trust the agent at %s: %w`, c.Socket, err)
+	}
+	if err := gob.NewEncoder(conn).Encode(m); err != nil {
+		return r, fmt.Errorf(`could not send message to the agent: %w`, err)
+	}
+	if err := gob.NewDecoder(conn).Decode(&r); err != nil {
+		return r, fmt.Errorf(`could not read reply from the agent: %w`, err)
+	}
+	if r.NoRequest {
+		return r, fmt.Errorf(`%w, which was made for request %s`, ErrNoRequest, m.Decode.ID)
+	} else if r.Error != `` {
+		return r, errors.New(r.Error)
+	}
+	return r, nil
+}
+
+// Add gives a request to the agent to hold. It returns when the agent will
+// forget it.
+func (c Client) Add(request data.PrivateRequest) (time.Time, error) {
+	r, err := c.call(message{Add: &request})
+	return r.Expires, err
+}
+
+// Decode has the agent decode a response. It returns the secret, the
+// verified signer, if any, and the public part of the request the response
+// was made for.
+func (c Client) Decode(response data.Response) ([]byte, *data.Signer, data.PublicRequest, error) {
+	r, err := c.call(message{Decode: &response})
+	return r.Secret, r.Signer, r.Request, err
+}
+
+// List describes the requests the agent holds.
+func (c Client) List() ([]Summary, error) {
+	r, err := c.call(message{List: true})
+	return r.List, err
+}
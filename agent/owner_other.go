@@ -0,0 +1,10 @@
+//go:build !unix
+
+package agent
+
+import "os"
+
+// fileOwner cannot tell who owns a file on this platform.
+func fileOwner(info os.FileInfo) (int, bool) {
+	return 0, false
+}
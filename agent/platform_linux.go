@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// LockMemory keeps the agent's memory out of swap, and out of core dumps,
+// so that the keys it holds are never written to disk.
+func LockMemory() error {
+	if err := unix.Mlockall(unix.MCL_CURRENT | unix.MCL_FUTURE); err != nil {
+		return fmt.Errorf(`could not lock memory (try raising "ulimit -l"): %w`, err)
+	}
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf(`could not disable core dumps: %w`, err)
+	}
+	return nil
+}
+
+// checkPeer refuses connections to processes run by other users: clients,
+// in case the socket's permissions are not enough, and agents, in case
+// another user is listening in the agent's place.
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return err
+	} else if credErr != nil {
+		return credErr
+	}
+	if int(cred.Uid) != os.Getuid() {
+		return fmt.Errorf(`the other end of the socket is run by user %d`, cred.Uid)
+	}
+	return nil
+}
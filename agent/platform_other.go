@@ -0,0 +1,19 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+)
+
+// LockMemory is only supported on Linux.
+func LockMemory() error {
+	return errors.New(`locking memory is not supported on this platform`)
+}
+
+// checkPeer relies on the permissions of the socket and its directory on
+// other platforms.
+func checkPeer(conn net.Conn) error {
+	return nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Unquabain/ephemeral/agent"
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+)
+
+var agentData struct {
+	socket   string
+	ttl      time.Duration
+	unlocked bool
+}
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Hold private requests in memory until their responses arrive.",
+	Long: `Runs an agent that holds private requests in locked memory, so that
+they never have to be written to disk. Requests made with "request --agent"
+are given to the agent, and "receive --agent" has the agent decode the
+response. The agent forgets each request when its TTL passes, or when it
+expires, whichever is sooner.
+
+The agent listens on a unix socket that only you can use. Run it in the
+background, and set the variable it prints in the shells you make requests
+from:
+    eval $(ephemeral agent &)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := agent.LockMemory(); err != nil {
+			if !agentData.unlocked {
+				log.WithError(err).Fatal(`Could not lock memory. Use --unlocked to run anyway.`)
+			}
+			log.WithError(err).Warn(`Could not lock memory. Keys may be written to swap.`)
+		}
+		listener, err := agent.Listen(agentData.socket)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not listen on socket.`)
+		}
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		go func() {
+			<-signals
+			listener.Close()
+		}()
+		fmt.Printf("%s=%s; export %s;\n", agent.SocketVariable, agentData.socket, agent.SocketVariable)
+		// Closing STDOUT lets the shell that started the agent in the
+		// background read the variable without waiting for it to exit.
+		os.Stdout.Close()
+		if err := agent.New(agentData.ttl).Serve(listener); err != nil {
+			log.WithError(err).Fatal(`Agent stopped.`)
+		}
+	},
+}
+
+// agentListCmd represents the agent list command
+var agentListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the requests the agent holds.",
+	Run: func(cmd *cobra.Command, args []string) {
+		summaries, err := agent.Client{Socket: agentData.socket}.List()
+		if err != nil {
+			log.WithError(err).Fatal(`Could not list requests.`)
+		}
+		for _, s := range summaries {
+			fmt.Printf("%s until %s  %s\n", s.ID, s.Expires.Local().Format(time.RFC1123), s.Description)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.AddCommand(agentListCmd)
+
+	agentCmd.PersistentFlags().StringVar(&agentData.socket, `socket`, agent.DefaultSocket(), "The socket the agent listens on. Clients find it in $"+agent.SocketVariable+".")
+	agentCmd.Flags().DurationVar(&agentData.ttl, `ttl`, 24*time.Hour, "How long to hold each request.")
+	agentCmd.Flags().BoolVar(&agentData.unlocked, `unlocked`, false, "Run even if memory cannot be locked.")
+}
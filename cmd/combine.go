@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Unquabain/ephemeral/data"
+	"github.com/Unquabain/ephemeral/envelope"
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+)
+
+var combineData struct {
+	secretFile string
+	format     string
+	field      string
+}
+
+// writeShare writes a received share as a SHARE envelope.
+func writeShare(w io.Writer, secret []byte) error {
+	var share data.Share
+	if err := share.UnmarshalBinary(secret); err != nil {
+		return err
+	}
+	env := envelope.Envelope{Name: `SHARE`, Prelude: share.Prelude()}
+	if err := env.Stuff(share); err != nil {
+		return fmt.Errorf(`could not stuff share envelope: %w`, err)
+	}
+	if _, err := env.WriteTo(w); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "This is share %d of %d. Combine it with %d more to rebuild the secret.\n", share.Index, share.Total, share.Threshold-1)
+	return nil
+}
+
+// readShares reads SHARE envelopes from the named files. A file may hold
+// more than one.
+func readShares(names []string) ([]data.Share, error) {
+	var shares []data.Share
+	for _, name := range names {
+		file, err := openInputFile(name)
+		if err != nil {
+			return nil, fmt.Errorf(`could not open %s: %w`, name, err)
+		}
+		found := 0
+		scanner := envelope.NewScanner(file)
+		for scanner.Scan() {
+			if scanner.Decoder().Name != `SHARE` {
+				continue
+			}
+			// A share that cannot be read is passed over by the next Scan,
+			// and reported with the rest.
+			env, err := scanner.Envelope()
+			if err != nil {
+				continue
+			}
+			var share data.Share
+			if err := env.Open(&share); err != nil {
+				file.Close()
+				return nil, fmt.Errorf(`could not open share %s: %w`, name, err)
+			}
+			shares = append(shares, share)
+			found++
+		}
+		file.Close()
+		warnRepairs(name, scanner.Repairs())
+		warnSkipped(name, scanner.Skipped())
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf(`could not read %s: %w`, name, err)
+		} else if found == 0 {
+			return nil, fmt.Errorf(`%s holds no shares`, name)
+		}
+	}
+	return shares, nil
+}
+
+// combineCmd represents the combine command
+var combineCmd = &cobra.Command{
+	Use:   "combine share...",
+	Short: "Rebuild a split secret from its shares.",
+	Long: `Rebuilds a secret that was split with respond --threshold. Each
+requester receives their share with the receive subcommand, which writes it
+out as a SHARE envelope. Once enough of the shares are gathered in one
+place, give their files to combine:
+    ephemeral combine alice.share bob.share carol.share
+
+A file may hold several shares, one after another.
+
+Shares are checked before they are combined, and the rebuilt secret is
+checked against a tag that was split along with it, so a damaged share, or
+a share of another secret, is reported rather than producing a wrong
+secret.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		shares, err := readShares(args)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not read shares.`)
+		}
+		secret, err := data.Combine(shares)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not rebuild secret.`)
+		}
+		secretFile, err := openSecretFile(combineData.secretFile)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not open secret file.`)
+		}
+		defer secretFile.Close()
+		if err := writeSecret(secretFile, secret, shares[0].Content, combineData.format, combineData.field); err != nil {
+			log.WithError(err).Fatal(`Could not write secret file.`)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(combineCmd)
+
+	combineCmd.Flags().StringVarP(&combineData.secretFile, `secret`, `s`, `-`, "Where to write the rebuilt secret.")
+	combineCmd.Flags().StringVar(&combineData.format, `format`, `table`, "How to write a structured secret: table or json.")
+	combineCmd.Flags().StringVarP(&combineData.field, `field`, `f`, ``, "Write only the value of this field of a structured secret.")
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/Unquabain/ephemeral/data"
+)
+
+// readFields builds a structured secret from values of the form
+// name[:type]=value. A value of @file reads the named file, and @- reads
+// STDIN. A leading @@ stands for a literal @. Without a type, files are
+// FileFields, URLs are URLFields and everything else is a TextField.
+func readFields(specs []string) (data.Fields, error) {
+	var (
+		fields    data.Fields
+		readStdin bool
+	)
+	for _, spec := range specs {
+		name, value, ok := strings.Cut(spec, `=`)
+		if !ok {
+			return nil, fmt.Errorf(`field %q should be given as name=value`, spec)
+		}
+		name, typeName, typed := strings.Cut(name, `:`)
+		field := data.Field{Name: name, Value: []byte(value)}
+		switch {
+		case strings.HasPrefix(value, `@@`):
+			field.Value = []byte(value[1:])
+		case value == `@-`:
+			if readStdin {
+				return nil, fmt.Errorf(`only one field may be read from STDIN`)
+			}
+			readStdin = true
+			b, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, fmt.Errorf(`could not read field %q from STDIN: %w`, name, err)
+			}
+			field.Value = b
+		case strings.HasPrefix(value, `@`):
+			b, err := os.ReadFile(value[1:])
+			if err != nil {
+				return nil, fmt.Errorf(`could not read field %q: %w`, name, err)
+			}
+			field.Value = b
+			field.Filename = filepath.Base(value[1:])
+			field.Type = data.FileField
+		case isURL(value):
+			field.Type = data.URLField
+		}
+		if typed {
+			t, err := data.ParseFieldType(typeName)
+			if err != nil {
+				return nil, err
+			}
+			field.Type = t
+		} else if field.Type == `` {
+			field.Type = data.TextField
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func isURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && u.Scheme != `` && u.Host != ``
+}
+
+// writeFields writes a structured secret in the given format: a table, or
+// JSON.
+func writeFields(w io.Writer, fields data.Fields, format string) error {
+	switch format {
+	case `json`:
+		enc := json.NewEncoder(w)
+		enc.SetIndent(``, `  `)
+		return enc.Encode(fields)
+	case `table`:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTYPE\tVALUE")
+		for _, field := range fields {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", field.Name, field.Type, tableValue(field))
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf(`unknown format %q: expected table or json`, format)
+	}
+}
+
+// tableValue shows a value that fits on one line, and describes one that
+// does not. Secret values are never shown in the table, which may be left on
+// the screen or in the terminal's scrollback.
+func tableValue(field data.Field) string {
+	if field.Type == data.SecretField {
+		return fmt.Sprintf(`(secret; use --field %s)`, field.Name)
+	}
+	if field.Type != data.FileField && utf8.Valid(field.Value) && !strings.ContainsAny(field.String(), "\r\n\t") {
+		return field.String()
+	}
+	desc := fmt.Sprintf(`%d bytes`, len(field.Value))
+	if field.Filename != `` {
+		desc = field.Filename + `, ` + desc
+	}
+	return fmt.Sprintf(`(%s; use --field %s)`, desc, field.Name)
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Unquabain/ephemeral/data"
+	"github.com/Unquabain/ephemeral/envelope"
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+)
+
+var groupData struct {
+	publicRequestFiles []string
+	groupRequestFile   string
+	description        string
+}
+
+// readMembers reads public requests from the named files. Group requests are
+// flattened into their members.
+func readMembers(names []string) ([]data.PublicRequest, []string, error) {
+	var (
+		members      []data.PublicRequest
+		descriptions []string
+	)
+	for _, name := range names {
+		env, err := readEnvelope(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch env.Name {
+		case `PUBLIC REQUEST`:
+			var request data.PublicRequest
+			if err := env.Open(&request); err != nil {
+				return nil, nil, fmt.Errorf(`could not open public request %s: %w`, name, err)
+			}
+			members = append(members, request)
+			descriptions = append(descriptions, request.Description)
+		case `GROUP REQUEST`:
+			var group data.GroupRequest
+			if err := env.Open(&group); err != nil {
+				return nil, nil, fmt.Errorf(`could not open group request %s: %w`, name, err)
+			}
+			members = append(members, group.Members...)
+			descriptions = append(descriptions, group.Description)
+		default:
+			return nil, nil, fmt.Errorf(`%s is a %s, not a public or group request`, name, env.Name)
+		}
+	}
+	return members, descriptions, nil
+}
+
+// groupPrelude lists the members of a group so that a responder can see who
+// will be able to read the response.
+func groupPrelude(group data.GroupRequest) string {
+	lines := []string{group.Description, ``, `Members:`}
+	for _, m := range group.Members {
+		if fingerprint, err := m.Fingerprint(); err == nil {
+			lines = append(lines, fmt.Sprintf(`  %s [%s] %s`, m.ID, fingerprint.Code(), m.Description))
+		} else {
+			lines = append(lines, fmt.Sprintf(`  %s %s`, m.ID, m.Description))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// groupCmd represents the group command
+var groupCmd = &cobra.Command{
+	Use:   "group",
+	Short: "Merge several public requests into one group request.",
+	Long: `Combines the public requests of several people into one group
+request. A single response to the group request can be decoded with the
+private request of any member.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var groupEnvelope envelope.Envelope
+		members, _, err := readMembers(groupData.publicRequestFiles)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not read public requests.`)
+		}
+		group, err := data.NewGroupRequest(groupData.description, members...)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not create group request.`)
+		}
+		groupFile, err := openOutputFile(groupData.groupRequestFile)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not open group request file.`)
+		}
+		defer groupFile.Close()
+
+		groupEnvelope.Name = `GROUP REQUEST`
+		groupEnvelope.Prelude = groupPrelude(group)
+		groupEnvelope.Headers = group.Headers()
+		if err := groupEnvelope.Stuff(group); err != nil {
+			log.WithError(err).Fatal(`Could not encode group request.`)
+		}
+		if _, err := groupEnvelope.WriteTo(groupFile); err != nil {
+			log.WithError(err).Fatal(`Could not write group request file.`)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(groupCmd)
+
+	groupCmd.Flags().StringArrayVarP(&groupData.publicRequestFiles, `public`, `b`, nil, "A public request to include in the group. May be given more than once.")
+	groupCmd.Flags().StringVarP(&groupData.groupRequestFile, `group`, `o`, `-`, "The file to write the group request to.")
+	groupCmd.Flags().StringVarP(&groupData.description, `description`, `d`, `Secret Information`, "An optional description of the secret being requested.")
+	groupCmd.MarkFlagRequired(`public`)
+}
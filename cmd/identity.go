@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Unquabain/ephemeral/data"
+	"github.com/Unquabain/ephemeral/envelope"
+	"github.com/apex/log"
+	"github.com/spf13/cobra"
+)
+
+var identityData struct {
+	identityFile       string
+	publicIdentityFile string
+	name               string
+}
+
+// readIdentity reads an identity made by the identity subcommand.
+func readIdentity(name string) (data.Identity, error) {
+	var identity data.Identity
+	env, err := readEnvelope(name)
+	if err != nil {
+		return identity, err
+	}
+	if env.Name != `IDENTITY` {
+		return identity, fmt.Errorf(`%s is a %s, not an identity`, name, env.Name)
+	}
+	if err := env.Open(&identity); err != nil {
+		return identity, fmt.Errorf(`could not open identity %s: %w`, name, err)
+	}
+	return identity, nil
+}
+
+// readSigners reads the public identities of expected signers. Each value
+// is either a public identity file or a key as printed by the identity
+// subcommand.
+func readSigners(values []string) ([]data.Signer, error) {
+	var signers []data.Signer
+	for _, value := range values {
+		if _, err := os.Stat(value); err != nil {
+			signer, err := data.ParseSignerKey(value)
+			if err != nil {
+				return nil, fmt.Errorf(`%s is neither a public identity file nor a key: %w`, value, err)
+			}
+			signers = append(signers, signer)
+			continue
+		}
+		var signer data.Signer
+		env, err := readEnvelope(value)
+		if err != nil {
+			return nil, err
+		}
+		if env.Name != `PUBLIC IDENTITY` {
+			return nil, fmt.Errorf(`%s is a %s, not a public identity`, value, env.Name)
+		}
+		if err := env.Open(&signer); err != nil {
+			return nil, fmt.Errorf(`could not open public identity %s: %w`, value, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// isExpected reports whether signer is among the expected signers. If none
+// are expected, any signer, or none, is acceptable.
+func isExpected(signer *data.Signer, expected []data.Signer) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	if signer == nil {
+		return false
+	}
+	for _, e := range expected {
+		if signer.Is(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// identityCmd represents the identity command
+var identityCmd = &cobra.Command{
+	Use:   "identity",
+	Short: "Create a long-term identity for signing requests.",
+	Long: `Creates two files: an identity, which is kept secret and reused to
+sign requests, and a public identity, which can be given to the people you
+trade secrets with so that they can recognize your signature.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var identityEnvelope, publicEnvelope envelope.Envelope
+		identity, err := data.NewIdentity(identityData.name)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not create a new identity.`)
+		}
+		identityFile, err := openSecretFile(identityData.identityFile)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not open identity file.`)
+		}
+		defer identityFile.Close()
+		publicFile, err := openOutputFile(identityData.publicIdentityFile)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not open public identity file.`)
+		}
+		defer publicFile.Close()
+
+		identityEnvelope.Name = `IDENTITY`
+		identityEnvelope.Prelude = identity.Name
+		if err := identityEnvelope.Stuff(identity); err != nil {
+			log.WithError(err).Fatal(`Could not encode identity.`)
+		}
+		if _, err := identityEnvelope.WriteTo(identityFile); err != nil {
+			log.WithError(err).Fatal(`Could not write identity file.`)
+		}
+
+		publicEnvelope.Name = `PUBLIC IDENTITY`
+		publicEnvelope.Prelude = identity.Public().String()
+		if err := publicEnvelope.Stuff(identity.Public()); err != nil {
+			log.WithError(err).Fatal(`Could not encode public identity.`)
+		}
+		if _, err := publicEnvelope.WriteTo(publicFile); err != nil {
+			log.WithError(err).Fatal(`Could not write public identity file.`)
+		}
+		fmt.Fprintf(os.Stderr, "Your identity key is %s\n", identity.Public().KeyString())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(identityCmd)
+
+	identityCmd.Flags().StringVarP(&identityData.identityFile, `identity`, `i`, `identity.txt`, "The name of the identity file, which must be kept secret.")
+	identityCmd.Flags().StringVarP(&identityData.publicIdentityFile, `public`, `b`, `-`, "The name of the public identity file, which can be shared.")
+	identityCmd.Flags().StringVarP(&identityData.name, `name`, `n`, ``, "The name you would like others to know you by.")
+}
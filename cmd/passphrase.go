@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// readPassphrase prompts for a passphrase on the terminal without echoing
+// it. The terminal is opened directly, because STDIN is often carrying a
+// response. If confirm is set, the passphrase must be typed twice.
+func readPassphrase(prompt string, confirm bool) ([]byte, error) {
+	tty, err := os.OpenFile(`/dev/tty`, os.O_RDWR, 0)
+	if err != nil {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, fmt.Errorf(`no terminal to read a passphrase from: %w`, err)
+		}
+		tty = os.Stdin
+	} else {
+		defer tty.Close()
+	}
+	fmt.Fprintf(os.Stderr, `%s: `, prompt)
+	passphrase, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf(`could not read passphrase: %w`, err)
+	}
+	if !confirm {
+		return passphrase, nil
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf(`passphrase is empty`)
+	}
+	fmt.Fprint(os.Stderr, `Repeat passphrase: `)
+	repeated, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf(`could not read passphrase: %w`, err)
+	}
+	if !bytes.Equal(passphrase, repeated) {
+		return nil, fmt.Errorf(`passphrases do not match`)
+	}
+	return passphrase, nil
+}
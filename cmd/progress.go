@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// progress counts the bytes read through it, and reports them on STDERR
+// when STDERR is a terminal.
+type progress struct {
+	r     io.Reader
+	verb  string
+	total int64
+	done  int64
+	shown time.Time
+	quiet bool
+}
+
+// newProgress wraps r. If the total size is not known, it should be 0.
+func newProgress(r io.Reader, verb string, total int64) *progress {
+	return &progress{
+		r:     r,
+		verb:  verb,
+		total: total,
+		quiet: !term.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if now := time.Now(); now.Sub(p.shown) > 200*time.Millisecond {
+		p.shown = now
+		p.show()
+	}
+	return n, err
+}
+
+func (p *progress) show() {
+	if p.quiet {
+		return
+	}
+	if p.total > 0 {
+		fmt.Fprintf(os.Stderr, "\r%s %s of %s (%d%%)  ", p.verb, byteSize(p.done), byteSize(p.total), p.done*100/p.total)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%s %s  ", p.verb, byteSize(p.done))
+	}
+}
+
+// finish shows the final count and ends the line.
+func (p *progress) finish() {
+	if p.quiet {
+		return
+	}
+	p.show()
+	fmt.Fprintln(os.Stderr)
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf(`%d B`, n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf(`%.1f %ciB`, float64(n)/float64(div), "KMGTPE"[exp])
+}
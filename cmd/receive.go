@@ -4,18 +4,261 @@ Package cmd implements the subcommands that the executable understands.
 package cmd
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"strings"
 
+	"github.com/Unquabain/ephemeral/agent"
 	"github.com/Unquabain/ephemeral/data"
 	"github.com/Unquabain/ephemeral/envelope"
 	"github.com/apex/log"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 var receiveData struct {
 	privateRequestFile string
 	responseFile       string
 	secretFile         string
+	signers            []string
+	format             string
+	field              string
+	agent              bool
+	sshIdentity        string
+	all                bool
+}
+
+// errRepeated means that a response was passed over because it had already
+// been received, as when it is quoted again further down a thread.
+var errRepeated = errors.New(`the response was already received`)
+
+// errAgentStream means that a streamed response was passed over because the
+// agent cannot decode it.
+var errAgentStream = errors.New(`streamed responses cannot be decoded by the agent`)
+
+// openPrivateRequest opens a private request envelope, prompting for the
+// passphrase if it is encrypted.
+func openPrivateRequest(env envelope.Envelope) (data.PrivateRequest, error) {
+	var request data.PrivateRequest
+	switch env.Name {
+	case `PRIVATE REQUEST`:
+		if err := env.Open(&request); err != nil {
+			return request, fmt.Errorf(`could not open private request envelope: %w`, err)
+		}
+		return request, nil
+	case `ENCRYPTED PRIVATE REQUEST`:
+		var encrypted data.EncryptedPrivateRequest
+		if err := env.Open(&encrypted); err != nil {
+			return request, fmt.Errorf(`could not open private request envelope: %w`, err)
+		}
+		passphrase, err := readPassphrase(fmt.Sprintf(`Passphrase for %q`, encrypted.Description), false)
+		if err != nil {
+			return request, err
+		}
+		return encrypted.Decrypt(passphrase)
+	default:
+		return request, fmt.Errorf(`%s is not a private request`, env.Name)
+	}
+}
+
+// openSSHIdentity reads an OpenSSH private key, prompting for its
+// passphrase if it is encrypted.
+func openSSHIdentity(name string) (data.PrivateRequest, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return data.PrivateRequest{}, err
+	}
+	return data.SSHPrivateRequest(b, func() ([]byte, error) {
+		return readPassphrase(fmt.Sprintf(`Passphrase for %s`, name), false)
+	})
+}
+
+// decodeFailed explains why the response could not be decoded, and exits.
+func decodeFailed(err error) {
+	var mismatch *data.MismatchError
+	if errors.As(err, &mismatch) {
+		log.Fatal(mismatch.Error())
+	}
+	log.WithError(err).Fatal(`Could not decode secret.`)
+}
+
+// checkResponse warns about late responses, and reports who signed the
+// response, refusing it if it was not signed by an expected signer.
+func checkResponse(request data.PublicRequest, response data.Response, signer *data.Signer, signers []data.Signer) {
+	if request.Late(response) {
+		log.WithField(`expired`, request.Expires).WithField(`responded`, response.Created).Warn(`This response was made after the request expired.`)
+	}
+	if !isExpected(signer, signers) {
+		log.WithField(`signer`, signer).Fatal(`Response was not signed by an expected responder.`)
+	} else if signer == nil {
+		fmt.Fprintln(os.Stderr, `Response is not signed.`)
+	} else {
+		fmt.Fprintf(os.Stderr, "Response was signed by %s\n", signer)
+	}
+}
+
+// otherRequest reports whether err means that a response was made for some
+// other request, so that it can be passed over in a thread that holds many.
+func otherRequest(err error) bool {
+	var mismatch *data.MismatchError
+	return errors.As(err, &mismatch) || errors.Is(err, agent.ErrNoRequest)
+}
+
+// responseKey identifies a response, so that one quoted many times in a
+// thread is only received once. It is the request's ID and the key
+// commitment, or, for responses without one, a hash of the key and data.
+func responseKey(response data.Response) string {
+	if len(response.Commitment) > 0 {
+		return response.ID.String() + `:` + hex.EncodeToString(response.Commitment)
+	}
+	hash := sha256.New()
+	key, _ := response.Key.MarshalBinary()
+	hash.Write(key)
+	hash.Write(response.Data)
+	return response.ID.String() + `:` + hex.EncodeToString(hash.Sum(nil))
+}
+
+// isTerminal reports whether w is written to a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// separate puts a line break between secrets written to the same file, so
+// that the second does not run on from the end of the first. Unless --all
+// was given, more than one secret is only written to a terminal, where they
+// are read rather than used.
+func separate(secretFile io.Writer, received int) {
+	if received == 0 {
+		return
+	}
+	if !receiveData.all && !isTerminal(secretFile) {
+		log.Fatal(`The response file holds more than one secret for the request. Give --all to write them all to the secret file.`)
+	}
+	fmt.Fprintln(secretFile)
+}
+
+// receiveStream decrypts a STREAMED RESPONSE into the secret file without
+// holding it in memory. The signature is checked before anything is
+// written, but a damaged stream is only detected when it is reached, so
+// the secret file may be left incomplete. If the response was made for
+// another request, or was already received, nothing is written, and the
+// error is returned.
+func receiveStream(request data.PrivateRequest, decoder *envelope.Decoder, signers []data.Signer, secretFile io.Writer, received int, seen map[string]bool) error {
+	var header data.Response
+	if err := envelope.ReadContent(decoder, &header); err != nil {
+		log.WithError(err).Fatal(`Could not open response envelope.`)
+	}
+	key := responseKey(header)
+	if seen[key] {
+		return errRepeated
+	}
+	secret, signer, err := request.DecodeStream(header, decoder)
+	if otherRequest(err) {
+		return err
+	} else if err != nil {
+		decodeFailed(err)
+	}
+	checkResponse(request.Public(), header, signer, signers)
+	separate(secretFile, received)
+	p := newProgress(secret, `Decrypted`, 0)
+	if _, err := io.Copy(secretFile, p); err != nil {
+		log.WithError(err).Fatal(`Could not decode secret. The secret file is incomplete.`)
+	}
+	p.finish()
+	seen[key] = true
+	return nil
+}
+
+// receiveResponse decrypts a RESPONSE into the secret file, with the
+// private request or, if it is nil, the agent. If the response was made for
+// another request, or was already received, nothing is written, and the
+// error is returned.
+func receiveResponse(request *data.PrivateRequest, env envelope.Envelope, signers []data.Signer, secretFile io.Writer, received int, seen map[string]bool) error {
+	var response data.Response
+	if err := env.Open(&response); err != nil {
+		log.WithError(err).Fatal(`Could not open response envelope.`)
+	}
+	key := responseKey(response)
+	if seen[key] {
+		return errRepeated
+	}
+	var (
+		secret []byte
+		signer *data.Signer
+		public data.PublicRequest
+		err    error
+	)
+	if request == nil {
+		secret, signer, public, err = agent.Client{Socket: agent.DefaultSocket()}.Decode(response)
+	} else {
+		secret, signer, err = request.DecodeSigned(response)
+		public = request.Public()
+	}
+	if otherRequest(err) {
+		return err
+	} else if err != nil {
+		decodeFailed(err)
+	}
+	checkResponse(public, response, signer, signers)
+	separate(secretFile, received)
+	if err := writeSecret(secretFile, secret, response.Content, receiveData.format, receiveData.field); err != nil {
+		log.WithError(err).Fatal(`Could not write secret file.`)
+	}
+	seen[key] = true
+	return nil
+}
+
+// receiveAge decrypts an age file, made by age or rage for the request's
+// age recipient, into the secret file.
+func receiveAge(request data.PrivateRequest, ciphertext io.Reader, secretFile io.Writer) {
+	secret, err := request.DecodeAge(ciphertext)
+	if err != nil {
+		log.WithError(err).Fatal(`Could not decode age file.`)
+	}
+	p := newProgress(secret, `Decrypted`, 0)
+	if _, err := io.Copy(secretFile, p); err != nil {
+		log.WithError(err).Fatal(`Could not decode secret. The secret file is incomplete.`)
+	}
+	p.finish()
+}
+
+// writeSecret writes a plain secret as it is. A structured secret is
+// written in the given format, or just the given field is written. A share
+// of a split secret is written as a SHARE envelope, to be combined later.
+func writeSecret(w io.Writer, secret []byte, content data.Content, format, name string) error {
+	if content == data.ShareContent {
+		return writeShare(w, secret)
+	}
+	if content != data.FieldsContent {
+		if name != `` {
+			return fmt.Errorf(`the secret has no fields`)
+		}
+		_, err := w.Write(secret)
+		return err
+	}
+	var fields data.Fields
+	if err := fields.UnmarshalBinary(secret); err != nil {
+		return err
+	}
+	if name == `` {
+		return writeFields(w, fields, format)
+	}
+	field, ok := fields.Get(name)
+	if !ok {
+		names := make([]string, len(fields))
+		for i, f := range fields {
+			names[i] = f.Name
+		}
+		return fmt.Errorf(`the secret has no field %q, only %s`, name, strings.Join(names, `, `))
+	}
+	_, err := w.Write(field.Value)
+	return err
 }
 
 // receiveCmd represents the receive command
@@ -24,26 +267,53 @@ var receiveCmd = &cobra.Command{
 	Short: "Receive a secret response to a request for secret information.",
 	Long: `Pairs the secret request (generated by the request subcommand)
 with the encrypted response (generated by the respond subcommand) and
-decrypts the secret.`,
+decrypts the secret.
+
+A structured secret, made with respond --field, is shown as a table, or as
+JSON with --format json. Give --field to write just one field's value.
+The values of secret fields are left out of the table.
+
+If the response carries one share of a split secret (made with respond
+--threshold), the share is written out as a SHARE envelope. Collect enough
+shares, and rebuild the secret with the combine subcommand.
+
+The response may also be an age file, armored or not, encrypted to a
+request made with request --format age.
+
+A response made with respond --ssh-recipient is decoded with the SSH
+private key instead of a private request:
+    ephemeral receive --ssh-identity ~/.ssh/id_ed25519 -r response.txt
+
+The response file may hold many responses, such as a long email thread or
+a file they were gathered into. Every response made for the request is
+decrypted, each secret on a line of its own, and the rest are passed over.
+A response quoted more than once is only decrypted once. More than one
+secret is only written to a file or pipe if --all is given.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
-			requestEnvelope, responseEnvelope envelope.Envelope
-			requestFile, responseFile         io.ReadCloser
-			secretFile                        io.WriteCloser
-			request                           data.PrivateRequest
-			response                          data.Response
-			err                               error
+			requestEnvelope           envelope.Envelope
+			requestFile, responseFile io.ReadCloser
+			secretFile                io.WriteCloser
+			request                   data.PrivateRequest
+			err                       error
 		)
-		if requestFile, err = openInputFile(receiveData.privateRequestFile); err != nil {
-			log.WithError(err).Fatal(`Could not open private request file.`)
-		}
-		defer requestFile.Close()
+		if receiveData.sshIdentity != `` {
+			if request, err = openSSHIdentity(receiveData.sshIdentity); err != nil {
+				log.WithError(err).Fatal(`Could not open SSH identity.`)
+			}
+		} else if !receiveData.agent {
+			if requestFile, err = openInputFile(receiveData.privateRequestFile); err != nil {
+				log.WithError(err).Fatal(`Could not open private request file.`)
+			}
+			defer requestFile.Close()
 
-		if _, err := requestEnvelope.ReadFrom(requestFile); err != nil {
-			log.WithError(err).Fatal(`Could not read private request file.`)
-		}
-		if err := requestEnvelope.Open(&request); err != nil {
-			log.WithError(err).Fatal(`Could not open private request envelope.`)
+			if _, err := requestEnvelope.ReadFrom(requestFile); err != nil {
+				log.WithError(err).Fatal(`Could not read private request file.`)
+			}
+			warnRepairs(receiveData.privateRequestFile, requestEnvelope.Repairs)
+			if request, err = openPrivateRequest(requestEnvelope); err != nil {
+				log.WithError(err).Fatal(`Could not open private request.`)
+			}
 		}
 
 		if responseFile, err = openInputFile(receiveData.responseFile); err != nil {
@@ -51,22 +321,100 @@ decrypts the secret.`,
 		}
 		defer responseFile.Close()
 
-		secretFile, err = openOutputFile(receiveData.secretFile)
+		secretFile, err = openSecretFile(receiveData.secretFile)
 		if err != nil {
 			log.WithError(err).Fatal(`Could not open secret file.`)
 		}
 		defer secretFile.Close()
 
-		if _, err := responseEnvelope.ReadFrom(responseFile); err != nil {
-			log.WithError(err).Fatal(`Could not read private response file.`)
+		buffered := bufio.NewReader(responseFile)
+		if prefix, _ := buffered.Peek(64); data.IsAge(prefix) {
+			if receiveData.agent {
+				log.Fatal(`Age files cannot be decoded by the agent.`)
+			}
+			if len(receiveData.signers) > 0 {
+				log.Fatal(`Age files are not signed, so they cannot come from a required signer.`)
+			}
+			receiveAge(request, buffered, secretFile)
+			return
+		}
+		signers, err := readSigners(receiveData.signers)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not read expected signers.`)
+		}
+		var decoding *data.PrivateRequest
+		if !receiveData.agent {
+			decoding = &request
+		}
+
+		// The response file may be a long thread, or hold many responses.
+		// Every one made for the request is decrypted, and the rest are
+		// passed over, as are repeats of those already received.
+		var (
+			scanner    = envelope.NewScanner(buffered)
+			seen       = make(map[string]bool)
+			responses  int
+			received   int
+			repeated   int
+			unreadable int
+			lastErr    error
+		)
+		for scanner.Scan() {
+			decoder := scanner.Decoder()
+			switch decoder.Name {
+			case `RESPONSE`:
+				responses++
+				// A response that cannot be read is passed over by the
+				// next Scan, and reported with the rest.
+				env, err := scanner.Envelope()
+				if err != nil {
+					unreadable++
+					lastErr = err
+					continue
+				}
+				lastErr = receiveResponse(decoding, env, signers, secretFile, received, seen)
+			case `STREAMED RESPONSE`:
+				responses++
+				if receiveData.agent {
+					log.Warn(`Streamed responses cannot be decoded by the agent.`)
+					unreadable++
+					lastErr = errAgentStream
+					continue
+				}
+				lastErr = receiveStream(request, decoder, signers, secretFile, received, seen)
+			default:
+				continue
+			}
+			if errors.Is(lastErr, errRepeated) {
+				responses--
+				repeated++
+			} else if lastErr == nil {
+				received++
+			}
 		}
-		if err := responseEnvelope.Open(&response); err != nil {
-			log.WithError(err).Fatal(`Could not open response envelope.`)
+		warnRepairs(receiveData.responseFile, scanner.Repairs())
+		warnSkipped(receiveData.responseFile, scanner.Skipped())
+		if err := scanner.Err(); err != nil {
+			log.WithError(err).Fatal(`Could not read response file.`)
 		}
-		if secret, err := request.Decode(response); err != nil {
-			log.WithError(err).Fatal(`Could not decode secret.`)
-		} else if _, err := secretFile.Write(secret); err != nil {
-			log.WithError(err).Fatal(`Could not write secret file.`)
+		switch {
+		case received > 0:
+			if responses > 1 {
+				fmt.Fprintf(os.Stderr, "Received %d of %d responses.\n", received, responses)
+			}
+			if repeated > 0 {
+				fmt.Fprintf(os.Stderr, "Passed over %d repeated responses.\n", repeated)
+			}
+		case responses == 0 && len(scanner.Skipped()) > 0:
+			log.Fatal(`The response file holds no responses that could be read.`)
+		case responses == 0:
+			log.Fatal(`The response file holds no responses.`)
+		case responses == 1:
+			decodeFailed(lastErr)
+		case unreadable > 0:
+			log.Fatalf(`None of the %d responses was made for the request and could be read.`, responses)
+		default:
+			log.Fatalf(`None of the %d responses was made for the request.`, responses)
 		}
 	},
 }
@@ -86,4 +434,10 @@ func init() {
 	receiveCmd.Flags().StringVarP(&receiveData.privateRequestFile, `private`, `v`, `request_private.txt`, "The name of the private request file to be used to decode the response.")
 	receiveCmd.Flags().StringVarP(&receiveData.responseFile, `response`, `r`, `-`, "The file the response was written to.")
 	receiveCmd.Flags().StringVarP(&receiveData.secretFile, `secret`, `s`, `-`, "Where to write the decrypted, secret data.")
+	receiveCmd.Flags().StringVar(&receiveData.sshIdentity, `ssh-identity`, ``, "An OpenSSH private key to decode a response made with respond --ssh-recipient, instead of a private request.")
+	receiveCmd.Flags().BoolVarP(&receiveData.agent, `agent`, `a`, false, "Have the agent (see the agent subcommand) decode the response, instead of reading a private request file.")
+	receiveCmd.Flags().StringVar(&receiveData.format, `format`, `table`, "How to write a structured secret: table or json.")
+	receiveCmd.Flags().StringVarP(&receiveData.field, `field`, `f`, ``, "Write only the value of this field of a structured secret.")
+	receiveCmd.Flags().BoolVar(&receiveData.all, `all`, false, "Write every secret in the response file to the secret file, even if it is not a terminal.")
+	receiveCmd.Flags().StringArrayVarP(&receiveData.signers, `require-signer`, `q`, nil, "Refuse responses not signed by this identity. Either a public identity file or a key. May be given more than once.")
 }
@@ -1,8 +1,13 @@
 package cmd
 
 import (
+	"fmt"
 	"io"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/Unquabain/ephemeral/agent"
 	"github.com/Unquabain/ephemeral/data"
 	"github.com/Unquabain/ephemeral/envelope"
 	"github.com/apex/log"
@@ -13,6 +18,13 @@ var requestData struct {
 	privateRequestFile string
 	publicRequestFile  string
 	description        string
+	curve              string
+	hybrid             bool
+	identityFile       string
+	passphrase         bool
+	expires            time.Duration
+	agent              bool
+	format             string
 }
 
 // requestCmd represents the request command
@@ -21,44 +33,154 @@ var requestCmd = &cobra.Command{
 	Short: "Create a request for secret data.",
 	Long: `Creates two files: a public request that can be shared over public
 channels, and a private request, which will be used to decode the response.
+
+The verification code shown on STDERR, and above both requests, is derived
+from the request's keys. Read it to the responder over the phone, or
+another channel, to make sure they respond to your request and not to one
+swapped in by someone else.
+
+With --format age, the public request is an age recipient (age1...)
+instead, so that a responder who already uses age or rage can encrypt to it
+without installing anything:
+    age -R request.txt -a -o response.txt secret.txt
+Age requests always use x25519, and cannot be hybrid, signed or expire. The private
+request is the same as ever, and receive decrypts the age file with it.
+
+With --format bech32 or base64url, the public request is written on a
+single line (ephpub1... or ephpub:...) that fits in a text message or a
+URL. Every subcommand reads these forms wherever it reads an envelope.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
 			privateEnvelope, publicEnvelope envelope.Envelope
 			privateFile, publicFile         io.WriteCloser
 		)
-		request, err := data.NewRequest(requestData.description)
+		if cmd.Flags().Changed(`expires`) && requestData.expires <= 0 {
+			log.WithField(`expires`, requestData.expires).Fatal(`The expiry time must be in the future. Leave out --expires for a request that never expires.`)
+		}
+		switch requestData.format {
+		case `envelope`, `bech32`, `base64url`:
+		case `age`:
+			if !cmd.Flags().Changed(`curve`) {
+				requestData.curve = data.X25519.String()
+			}
+			if requestData.identityFile != `` {
+				log.Fatal(`Age recipients cannot be signed.`)
+			}
+			if requestData.hybrid {
+				log.Fatal(`Age recipients cannot be hybrid.`)
+			}
+			if !strings.EqualFold(requestData.curve, data.X25519.String()) {
+				log.WithField(`curve`, requestData.curve).Fatal(`Age recipients must use x25519.`)
+			}
+			if requestData.expires != 0 {
+				log.Fatal(`Age recipients cannot expire, since age does not check expiry times.`)
+			}
+		default:
+			log.WithField(`format`, requestData.format).Fatal(`Unknown format. Expected envelope, bech32, base64url or age.`)
+		}
+		curve, err := data.ParseCurve(requestData.curve)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not select a curve.`)
+		}
+		request, err := data.NewCurveRequest(requestData.description, curve)
 		if err != nil {
 			log.WithError(err).Fatal(`Could not create a new request.`)
 		}
-		privateFile, err = openOutputFile(requestData.privateRequestFile)
+		request.ExpireAfter(requestData.expires)
+		request.Age = requestData.format == `age`
+		if requestData.hybrid {
+			if err := request.MakeHybrid(); err != nil {
+				log.WithError(err).Fatal(`Could not create a hybrid request.`)
+			}
+		}
+		var passphrase []byte
+		if requestData.passphrase {
+			if passphrase, err = readPassphrase(`Passphrase for the private request`, true); err != nil {
+				log.WithError(err).Fatal(`Could not read passphrase.`)
+			}
+		}
+		prelude, err := request.Prelude()
 		if err != nil {
-			log.WithError(err).Fatal(`Could not open private request file.`)
+			log.WithError(err).Fatal(`Could not fingerprint request.`)
+		}
+		if requestData.agent {
+			if passphrase != nil || cmd.Flags().Changed(`private`) {
+				log.Fatal(`A request held by the agent has no private request file to write or protect.`)
+			}
+			until, err := agent.Client{Socket: agent.DefaultSocket()}.Add(request)
+			if err != nil {
+				log.WithError(err).Fatal(`Could not give the request to the agent.`)
+			}
+			fmt.Fprintf(os.Stderr, "The agent holds the private request until %s.\n", until.Local().Format(time.RFC1123))
+		} else {
+			privateFile, err = openSecretFile(requestData.privateRequestFile)
+			if err != nil {
+				log.WithError(err).Fatal(`Could not open private request file.`)
+			}
+			defer privateFile.Close()
+			privateEnvelope.Name = `PRIVATE REQUEST`
+			privateEnvelope.Prelude = prelude
+			privateEnvelope.Headers = request.Headers()
+			if passphrase == nil {
+				if err := privateEnvelope.Stuff(request); err != nil {
+					log.WithError(err).Fatal(`Could not encode private request.`)
+				}
+			} else if encrypted, err := request.Encrypt(passphrase); err != nil {
+				log.WithError(err).Fatal(`Could not encrypt private request.`)
+			} else if err := privateEnvelope.Stuff(encrypted); err != nil {
+				log.WithError(err).Fatal(`Could not encode private request.`)
+			} else {
+				privateEnvelope.Name = `ENCRYPTED PRIVATE REQUEST`
+				privateEnvelope.Headers = encrypted.Headers()
+			}
+
+			if _, err := privateEnvelope.WriteTo(privateFile); err != nil {
+				log.WithError(err).Fatal(`Could not write request to private request file`)
+			}
 		}
-		defer privateFile.Close()
+
 		publicFile, err = openOutputFile(requestData.publicRequestFile)
 		if err != nil {
 			log.WithError(err).Fatal(`Could not open public request file.`)
 		}
 		defer publicFile.Close()
-		privateEnvelope.Name = `PRIVATE REQUEST`
-		privateEnvelope.Prelude = request.Description
-		if err := privateEnvelope.Stuff(request); err != nil {
-			log.WithError(err).Fatal(`Could not encode private request.`)
-		}
 
-		if _, err := io.Copy(privateFile, privateEnvelope.Reader()); err != nil {
-			log.WithError(err).Fatal(`Could not write request to private request file`)
+		public := request.Public()
+		if requestData.format == `age` {
+			recipient, err := public.AgeRecipient()
+			if err != nil {
+				log.WithError(err).Fatal(`Could not make an age recipient.`)
+			}
+			// Age reads recipient files with comments, so the description can
+			// go along with the recipient.
+			if _, err := fmt.Fprintf(publicFile, "# %s\n%s\n", request.Description, recipient); err != nil {
+				log.WithError(err).Fatal(`Could not write request to public request file.`)
+			}
+			fmt.Fprintf(os.Stderr, "Age recipient for request %s: %s\n", request.ID, recipient)
+			return
+		}
+		if requestData.identityFile != `` {
+			if identity, err := readIdentity(requestData.identityFile); err != nil {
+				log.WithError(err).Fatal(`Could not read identity.`)
+			} else if err := public.Sign(identity); err != nil {
+				log.WithError(err).Fatal(`Could not sign public request.`)
+			}
 		}
 
 		publicEnvelope.Name = `PUBLIC REQUEST`
-		publicEnvelope.Prelude = request.Description
-		if err := publicEnvelope.Stuff(request.Public()); err != nil {
+		publicEnvelope.Prelude = prelude
+		publicEnvelope.Headers = public.Headers()
+		if err := publicEnvelope.Stuff(public); err != nil {
 			log.WithError(err).Fatal(`Could not write encode public request.`)
 		}
-		if _, err := io.Copy(publicFile, publicEnvelope.Reader()); err != nil {
+		if err := writeEnvelope(publicFile, publicEnvelope, requestData.format); err != nil {
 			log.WithError(err).Fatal(`Could not write request to public request file.`)
 		}
+		if fingerprint, err := request.Fingerprint(); err == nil {
+			fmt.Fprintf(os.Stderr, "Verification code for request %s: %s\n", request.ID, fingerprint.Code())
+			fmt.Fprintln(os.Stderr, `The responder should see the same code. Compare it over a channel other than the one the public request is sent on.`)
+		}
 	},
 }
 
@@ -76,4 +198,11 @@ func init() {
 	requestCmd.Flags().StringVarP(&requestData.privateRequestFile, `private`, `v`, `request_private.txt`, "The name of the secret request file to be used to decode the response.")
 	requestCmd.Flags().StringVarP(&requestData.publicRequestFile, `public`, `b`, `-`, "The name of the public request file to be sent over public channels.")
 	requestCmd.Flags().StringVarP(&requestData.description, `description`, `d`, `Secret Information`, "An optional description of the secret being requested.")
+	requestCmd.Flags().StringVarP(&requestData.curve, `curve`, `c`, `random`, "The elliptic curve to use: p256, p384, p521, x25519 or random.")
+	requestCmd.Flags().BoolVarP(&requestData.hybrid, `hybrid`, `q`, false, "Combine the elliptic curve key with a post-quantum ML-KEM-768 key.")
+	requestCmd.Flags().StringVarP(&requestData.identityFile, `identity`, `i`, ``, "An identity file (generated by the identity subcommand) to sign the public request with.")
+	requestCmd.Flags().BoolVarP(&requestData.passphrase, `passphrase`, `p`, false, "Prompt for a passphrase, and encrypt the private request with it.")
+	requestCmd.Flags().BoolVarP(&requestData.agent, `agent`, `a`, false, "Give the private request to the agent (see the agent subcommand) instead of writing a private request file.")
+	requestCmd.Flags().StringVar(&requestData.format, `format`, `envelope`, "The form of the public request: envelope; bech32 or base64url for a single line; or age for an age recipient.")
+	requestCmd.Flags().DurationVarP(&requestData.expires, `expires`, `e`, 0, "How long the request stays valid, e.g. 48h. By default, it never expires.")
 }
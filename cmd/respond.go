@@ -2,7 +2,12 @@ package cmd
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/Unquabain/ephemeral/data"
 	"github.com/Unquabain/ephemeral/envelope"
@@ -11,9 +16,184 @@ import (
 )
 
 var respondData struct {
-	publicRequestFile string
-	dataFile          string
-	responseFile      string
+	publicRequestFiles []string
+	dataFile           string
+	responseFile       string
+	requesters         []string
+	identityFile       string
+	allowExpired       bool
+	stream             bool
+	fields             []string
+	padding            string
+	threshold          int
+	sshRecipients      []string
+	format             string
+}
+
+// openRecipients reads the named public and group requests, and the keys in
+// the named SSH public key files. A single recipient is answered directly.
+// Anything more is answered as a group.
+func openRecipients(names, sshNames []string) (data.Encoder, string, error) {
+	members, descriptions, err := readMembers(names)
+	if err != nil {
+		return nil, ``, err
+	}
+	for _, name := range sshNames {
+		keys, err := readSSHRecipients(name)
+		if err != nil {
+			return nil, ``, err
+		}
+		for _, key := range keys {
+			members = append(members, key)
+			descriptions = append(descriptions, key.Description)
+		}
+	}
+	if len(members) == 1 {
+		return members[0], members[0].Description, nil
+	}
+	group, err := data.NewGroupRequest(strings.Join(descriptions, `; `), members...)
+	if err != nil {
+		return nil, ``, err
+	}
+	return group, groupPrelude(group), nil
+}
+
+// readSSHRecipients reads the ssh-ed25519 and ECDSA keys in an SSH public
+// key file, warning about any others.
+func readSSHRecipients(name string) ([]data.PublicRequest, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf(`could not read SSH public keys: %w`, err)
+	}
+	keys, skipped, err := data.ParseSSHRecipients(b)
+	for _, s := range skipped {
+		log.WithField(`file`, name).WithField(`key`, s).Warn(`Skipping SSH key that cannot be a recipient.`)
+	}
+	if err != nil {
+		return nil, fmt.Errorf(`could not read SSH public keys from %s: %w`, name, err)
+	}
+	return keys, nil
+}
+
+// streamThreshold is the size above which data files are streamed, rather
+// than read into memory.
+const streamThreshold = 1024 * 1024
+
+// fileSize returns the size of f if it is a regular file, or 0.
+func fileSize(f io.Reader) int64 {
+	file, ok := f.(*os.File)
+	if !ok {
+		return 0
+	}
+	if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+		return info.Size()
+	}
+	return 0
+}
+
+// readAhead returns the size of the data file, and a reader for all of it.
+// The size of a pipe is not known until it has been read, so up to
+// streamThreshold of it is read ahead, and if there is more, the size is
+// returned as -1, so that it will be streamed.
+func readAhead(f io.Reader) (int64, io.Reader, error) {
+	if size := fileSize(f); size > 0 {
+		return size, f, nil
+	}
+	head, err := io.ReadAll(io.LimitReader(f, streamThreshold+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	all := io.MultiReader(bytes.NewReader(head), f)
+	if len(head) > streamThreshold {
+		return -1, all, nil
+	}
+	return int64(len(head)), all, nil
+}
+
+// streamResponse encrypts the data into a STREAMED RESPONSE envelope
+// without holding it in memory.
+func streamResponse(request data.Encoder, description string, identity *data.Identity, dataFile *progress, responseFile io.Writer) {
+	if respondData.format != `envelope` {
+		log.WithField(`format`, respondData.format).Fatal(`Streamed responses can only be written as envelopes.`)
+	}
+	responseEnvelope := envelope.NewEncoder(responseFile, `STREAMED RESPONSE`, description)
+	header, stream, err := request.EncodeStream(responseEnvelope)
+	if err != nil {
+		log.WithError(err).Fatal(`Could not encode response.`)
+	}
+	if identity != nil {
+		if err := header.Sign(*identity); err != nil {
+			log.WithError(err).Fatal(`Could not sign response.`)
+		}
+	}
+	responseEnvelope.Headers = header.Headers()
+	if err := envelope.WriteContent(responseEnvelope, header); err != nil {
+		log.WithError(err).Fatal(`Could not write response header.`)
+	}
+	if _, err := io.Copy(stream, dataFile); err != nil {
+		log.WithError(err).Fatal(`Could not encrypt data file.`)
+	}
+	if err := stream.Close(); err != nil {
+		log.WithError(err).Fatal(`Could not encrypt data file.`)
+	} else if err := responseEnvelope.Close(); err != nil {
+		log.WithError(err).Fatal(`Could not write response file.`)
+	}
+	dataFile.finish()
+}
+
+// shareFile names the file a share is written to: share 2 of resp.txt is
+// written to resp.share2.txt. Shares sent to STDOUT follow one another.
+func shareFile(name string, index int) string {
+	if name == `-` {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf(`%s.share%d%s`, strings.TrimSuffix(name, ext), index, ext)
+}
+
+// splitResponse splits the secret among the members, so that threshold of
+// them must combine their shares to rebuild it. Each member gets a response
+// holding their own share.
+func splitResponse(members []data.PublicRequest, threshold int, secret []byte, content data.Content, padding data.Padding, identity *data.Identity) {
+	shares, err := data.SplitContent(secret, content, len(members), threshold)
+	if err != nil {
+		log.WithError(err).Fatal(`Could not split secret.`)
+	}
+	for i, member := range members {
+		plaintext, err := shares[i].MarshalBinary()
+		if err != nil {
+			log.WithError(err).Fatal(`Could not encode share.`)
+		}
+		response, err := member.EncodeContent(plaintext, data.ShareContent, padding)
+		if err != nil {
+			log.WithError(err).WithField(`request`, member.ID).Fatal(`Could not encode response.`)
+		}
+		if identity != nil {
+			if err := response.Sign(*identity); err != nil {
+				log.WithError(err).Fatal(`Could not sign response.`)
+			}
+		}
+		responseEnvelope := envelope.Envelope{
+			Name:    `RESPONSE`,
+			Prelude: fmt.Sprintf("%s\n\n%s", member.Description, shares[i].Prelude()),
+			Headers: response.Headers(),
+		}
+		if err := responseEnvelope.Stuff(response); err != nil {
+			log.WithError(err).Fatal(`Could not stuff response envelope.`)
+		}
+		name := shareFile(respondData.responseFile, shares[i].Index)
+		responseFile, err := openOutputFile(name)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not open output file.`)
+		}
+		if err := writeEnvelope(responseFile, responseEnvelope, respondData.format); err != nil {
+			log.WithError(err).Fatal(`Could not write response file.`)
+		}
+		if name != `-` {
+			responseFile.Close()
+			fmt.Fprintf(os.Stderr, "Share %d for request %s (%s) written to %s\n", shares[i].Index, member.ID, member.Description, name)
+		}
+	}
 }
 
 // respondCmd represents the respond command
@@ -21,53 +201,175 @@ var respondCmd = &cobra.Command{
 	Use:   "respond",
 	Short: "Reply to a request for secret information",
 	Long: `If given a public request (generated with the request subcommand),
-formulate a reply.`,
+formulate a reply. If given several public requests, or a group request
+(generated with the group subcommand), formulate one reply that any of the
+requesters can decode.
+
+The verification code of each request is shown on STDERR. Before sending
+anything sensitive, check it with the requester over another channel.
+
+Data files larger than a megabyte are streamed into a STREAMED RESPONSE,
+so that they never have to fit in memory. This holds for data piped to
+STDIN as well: the first megabyte is read ahead, and if there is more, the
+whole of it is streamed.
+
+Instead of a data file, a structured secret can be built from named fields:
+    ephemeral respond -b request.txt -f host=db.example.com -f user=admin \
+        -f password:secret=@- -f ca=@ca.pem
+
+The secret is padded before it is encrypted, so that the response does not
+give away its exact length. The default, padme, adds at most 12%; power2
+hides more, at the cost of up to twice the size. Streamed responses are
+not padded.
+
+With --threshold, the secret is split among the requesters so that no one
+of them can read it alone. Each gets a response holding one share, written
+to its own file, and any threshold of them can rebuild the secret with the
+combine subcommand:
+    ephemeral respond -b alice.pub -b bob.pub -b carol.pub --threshold 2 \
+        -d root.txt -r root.txt
+
+With --ssh-recipient, the response is made for the holder of an existing
+ssh-ed25519 or ECDSA key, with no request round trip. The file can be an
+authorized_keys file, or someone's keys saved from GitHub; every key in it
+that can be a recipient is used:
+    curl https://github.com/alice.keys > alice.keys
+    ephemeral respond --ssh-recipient alice.keys -d token.txt -r response.txt
+
+With --format bech32 or base64url, the response is written on a single line
+(ephresp1... or ephresp:...), for a text message or a ticket. Streamed
+responses are always written as envelopes.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
-			requestEnvelope, responseEnvelope envelope.Envelope
-			requestFile, dataFile             io.ReadCloser
-			responseFile                      io.WriteCloser
-			request                           data.PublicRequest
-			err                               error
+			responseEnvelope envelope.Envelope
+			dataFile         io.ReadCloser
+			responseFile     io.WriteCloser
+			err              error
 		)
-		requestFile, err = openInputFile(respondData.publicRequestFile)
+		switch respondData.format {
+		case `envelope`, `bech32`, `base64url`:
+		default:
+			log.WithField(`format`, respondData.format).Fatal(`Unknown format. Expected envelope, bech32 or base64url.`)
+		}
+		padding, err := data.ParsePadding(respondData.padding)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not read padding policy.`)
+		}
+		publics := respondData.publicRequestFiles
+		if len(respondData.sshRecipients) > 0 && !cmd.Flags().Changed(`public`) {
+			publics = nil
+		}
+		request, description, err := openRecipients(publics, respondData.sshRecipients)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not open request.`)
+		}
+		requesters, err := readSigners(respondData.requesters)
 		if err != nil {
-			log.WithError(err).Fatal(`Could not open request file.`)
+			log.WithError(err).Fatal(`Could not read expected requesters.`)
+		}
+		for _, member := range request.Requests() {
+			if member.Expired(time.Now()) {
+				if !respondData.allowExpired {
+					log.WithField(`request`, member.ID).WithField(`expired`, member.Expires).Fatal(`Request has expired.`)
+				}
+				log.WithField(`request`, member.ID).WithField(`expired`, member.Expires).Warn(`Request has expired.`)
+			}
+			fingerprint, err := member.Fingerprint()
+			if err != nil {
+				log.WithError(err).WithField(`request`, member.ID).Fatal(`Could not fingerprint request.`)
+			}
+			fmt.Fprintf(os.Stderr, "Verification code for request %s: %s\n", member.ID, fingerprint.Code())
+			if signer, err := member.Verify(); err != nil {
+				log.WithError(err).WithField(`request`, member.ID).Fatal(`Request signature is not valid.`)
+			} else if !isExpected(signer, requesters) {
+				log.WithField(`request`, member.ID).WithField(`signer`, signer).Fatal(`Request was not signed by an expected requester.`)
+			} else if signer == nil {
+				fmt.Fprintf(os.Stderr, "Request %s (%s) is not signed.\n", member.ID, member.Description)
+			} else {
+				fmt.Fprintf(os.Stderr, "Request %s (%s) was signed by %s\n", member.ID, member.Description, signer)
+			}
 		}
-		defer requestFile.Close()
 
-		if _, err := requestEnvelope.ReadFrom(requestFile); err != nil {
-			log.WithError(err).Fatal(`Could not read request file: %s`)
+		var identity *data.Identity
+		if respondData.identityFile != `` {
+			if id, err := readIdentity(respondData.identityFile); err != nil {
+				log.WithError(err).Fatal(`Could not read identity.`)
+			} else {
+				identity = &id
+			}
 		}
-		if err := requestEnvelope.Open(&request); err != nil {
-			log.WithError(err).Fatal(`Could not open request envelope: %s`)
+
+		if respondData.threshold > 0 && respondData.stream {
+			log.Fatal(`Split secrets cannot be streamed.`)
 		}
 
-		dataFile, err = openInputFile(respondData.dataFile)
-		if err != nil {
-			log.WithError(err).Fatal(`Could not open data file: %s`)
+		buff, content := new(bytes.Buffer), data.RawContent
+		if len(respondData.fields) > 0 {
+			if respondData.stream {
+				log.Fatal(`Structured secrets cannot be streamed.`)
+			}
+			fields, err := readFields(respondData.fields)
+			if err != nil {
+				log.WithError(err).Fatal(`Could not read fields.`)
+			}
+			plaintext, err := fields.MarshalBinary()
+			if err != nil {
+				log.WithError(err).Fatal(`Could not encode fields.`)
+			}
+			buff.Write(plaintext)
+			content = data.FieldsContent
+		} else {
+			dataFile, err = openInputFile(respondData.dataFile)
+			if err != nil {
+				log.WithError(err).Fatal(`Could not open data file: %s`)
+			}
+			defer dataFile.Close()
 		}
-		defer dataFile.Close()
 
-		responseFile, err = openOutputFile(respondData.responseFile)
-		if err != nil {
-			log.WithError(err).Fatal(`Could not open output file: %s`)
+		// Split secrets are written to a file per share.
+		if respondData.threshold == 0 {
+			responseFile, err = openOutputFile(respondData.responseFile)
+			if err != nil {
+				log.WithError(err).Fatal(`Could not open output file: %s`)
+			}
+			defer responseFile.Close()
+		}
+
+		if dataFile != nil {
+			size, all, err := readAhead(dataFile)
+			if err != nil {
+				log.WithError(err).Fatal(`Could not read data file: %s`)
+			}
+			if respondData.threshold == 0 && (respondData.stream || size < 0 || size > streamThreshold) {
+				streamResponse(request, description, identity, newProgress(all, `Encrypted`, max(size, 0)), responseFile)
+				return
+			}
+			if _, err := io.Copy(buff, all); err != nil {
+				log.WithError(err).Fatal(`Could not read data file: %s`)
+			}
 		}
-		defer responseFile.Close()
 
-		buff := new(bytes.Buffer)
-		if _, err := io.Copy(buff, dataFile); err != nil {
-			log.WithError(err).Fatal(`Could not read data file: %s`)
+		if respondData.threshold > 0 {
+			splitResponse(request.Requests(), respondData.threshold, buff.Bytes(), content, padding, identity)
+			return
 		}
 
 		responseEnvelope.Name = `RESPONSE`
-		responseEnvelope.Prelude = request.Description
-		if response, err := request.Encode(buff.Bytes()); err != nil {
+		responseEnvelope.Prelude = description
+		response, err := request.EncodeContent(buff.Bytes(), content, padding)
+		if err != nil {
 			log.WithError(err).Fatal(`Could not encode response: %s`)
-		} else if err := responseEnvelope.Stuff(response); err != nil {
+		}
+		if identity != nil {
+			if err := response.Sign(*identity); err != nil {
+				log.WithError(err).Fatal(`Could not sign response.`)
+			}
+		}
+		responseEnvelope.Headers = response.Headers()
+		if err := responseEnvelope.Stuff(response); err != nil {
 			log.WithError(err).Fatal(`Could not stuff response envelope: %s`)
 		}
-		if _, err := io.Copy(responseFile, responseEnvelope.Reader()); err != nil {
+		if err := writeEnvelope(responseFile, responseEnvelope, respondData.format); err != nil {
 			log.WithError(err).Fatal(`Could not write response file: %s`)
 		}
 	},
@@ -85,7 +387,16 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// respondCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-	respondCmd.Flags().StringVarP(&respondData.publicRequestFile, `public`, `b`, `-`, "The name of the public request file sent over public channels.")
+	respondCmd.Flags().StringArrayVarP(&respondData.publicRequestFiles, `public`, `b`, []string{`-`}, "The name of the public request file sent over public channels. Give it more than once, or give a group request, to answer several requesters at once.")
 	respondCmd.Flags().StringVarP(&respondData.dataFile, `data`, `d`, `-`, "A data file to encrypt in the response.")
 	respondCmd.Flags().StringVarP(&respondData.responseFile, `response`, `r`, `-`, "The file to write the response to.")
+	respondCmd.Flags().StringArrayVarP(&respondData.requesters, `require-requester`, `q`, nil, "Refuse requests not signed by this identity. Either a public identity file or a key. May be given more than once.")
+	respondCmd.Flags().StringVarP(&respondData.identityFile, `identity`, `i`, ``, "An identity file (generated by the identity subcommand) to sign the response with.")
+	respondCmd.Flags().BoolVar(&respondData.allowExpired, `allow-expired`, false, "Respond to expired requests with a warning, rather than refusing.")
+	respondCmd.Flags().StringArrayVarP(&respondData.fields, `field`, `f`, nil, "Send a named field of a structured secret instead of a data file, as name[:type]=value. The type is text, secret, file or url. A value of @file reads a file, and @- reads STDIN. May be given more than once.")
+	respondCmd.Flags().BoolVar(&respondData.stream, `stream`, false, "Stream the data into the response, even if it is small.")
+	respondCmd.Flags().StringArrayVar(&respondData.sshRecipients, `ssh-recipient`, nil, "An SSH public key file. Respond to the holders of its ssh-ed25519 and ECDSA keys. May be given more than once.")
+	respondCmd.Flags().IntVarP(&respondData.threshold, `threshold`, `k`, 0, "Split the secret among the requesters, so that this many of them must combine their shares to read it.")
+	respondCmd.Flags().StringVar(&respondData.format, `format`, `envelope`, "The form of the response: envelope, or bech32 or base64url for a single line.")
+	respondCmd.Flags().StringVar(&respondData.padding, `padding`, data.DefaultPadding.String(), "How to pad the secret to hide its length: none, padme or power2.")
 }
@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"fmt"
 	"io"
 	"os"
 
+	"github.com/Unquabain/ephemeral/envelope"
 	"github.com/apex/log"
 	"github.com/spf13/cobra"
 )
@@ -16,6 +18,25 @@ func openOutputFile(name string) (io.WriteCloser, error) {
 	}
 	return os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 }
+
+// openSecretFile is like openOutputFile, but the file can only be read by
+// its owner. The mode given to OpenFile only applies to a file it creates,
+// so one that already exists is made private before anything is written.
+func openSecretFile(name string) (io.WriteCloser, error) {
+	if name == `-` {
+		return os.Stdout, nil
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
 func openInputFile(name string) (io.ReadCloser, error) {
 	if name == `-` {
 		return os.Stdin, nil
@@ -23,6 +44,62 @@ func openInputFile(name string) (io.ReadCloser, error) {
 	return os.Open(name)
 }
 
+// writeEnvelope writes an envelope in the given form: armored, or as a
+// single line of Bech32 or base64url, for text messages and URLs.
+func writeEnvelope(w io.Writer, env envelope.Envelope, format string) error {
+	var (
+		line string
+		err  error
+	)
+	switch format {
+	case `bech32`:
+		line, err = env.Bech32()
+	case `base64url`:
+		line, err = env.Base64URL()
+	case `envelope`:
+		_, err := env.WriteTo(w)
+		return err
+	default:
+		return fmt.Errorf(`unknown format %q: expected envelope, bech32 or base64url`, format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, line)
+	return err
+}
+
+// readEnvelope reads a single envelope from the named file.
+func readEnvelope(name string) (envelope.Envelope, error) {
+	var env envelope.Envelope
+	file, err := openInputFile(name)
+	if err != nil {
+		return env, fmt.Errorf(`could not open %s: %w`, name, err)
+	}
+	defer file.Close()
+	if _, err := env.ReadFrom(file); err != nil {
+		return env, fmt.Errorf(`could not read %s: %w`, name, err)
+	}
+	warnRepairs(name, env.Repairs)
+	return env, nil
+}
+
+// warnRepairs tells the user what had to be repaired to read an envelope,
+// so that they know it was mangled on its way to them.
+func warnRepairs(name string, repairs []string) {
+	for _, repair := range repairs {
+		log.WithField(`file`, name).Warn(`Repaired envelope: ` + repair)
+	}
+}
+
+// warnSkipped tells the user about the envelopes in a file that could not
+// be read, and were passed over.
+func warnSkipped(name string, skipped []error) {
+	for _, err := range skipped {
+		log.WithField(`file`, name).WithError(err).Warn(`Passed over an envelope that could not be read.`)
+	}
+}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "ephemeral",
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenSecretFile(t *testing.T) {
+	assert := assert.New(t)
+	name := filepath.Join(t.TempDir(), `secret.txt`)
+
+	// A file that already exists, and that anyone can read, is made private
+	// before the secret is written to it.
+	assert.NoError(os.WriteFile(name, []byte(`old`), 0644))
+	assert.NoError(os.Chmod(name, 0644))
+	f, err := openSecretFile(name)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = f.Write([]byte(`new`))
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	info, err := os.Stat(name)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	contents, err := os.ReadFile(name)
+	assert.NoError(err)
+	assert.Equal(`new`, string(contents))
+}
@@ -2,13 +2,18 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/Unquabain/ephemeral/data"
 	"github.com/Unquabain/ephemeral/server"
+	"github.com/apex/log"
 	"github.com/spf13/cobra"
 )
 
 var serveData struct {
-	Addr string
+	Addr    string
+	Padding string
+	Options server.Options
 }
 
 // serveCmd represents the serve command
@@ -19,8 +24,16 @@ var serveCmd = &cobra.Command{
 /request, /respond, and /receive, which correspond to the three subdommands.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
+		if serveData.Options.ShortExpiry <= 0 {
+			log.WithField(`short-expires`, serveData.Options.ShortExpiry).Fatal(`The short flow's expiry time must be in the future.`)
+		}
+		padding, err := data.ParsePadding(serveData.Padding)
+		if err != nil {
+			log.WithError(err).Fatal(`Could not read padding policy.`)
+		}
+		serveData.Options.Padding = padding
 		fmt.Printf("Listening on %s. CTRL+C to stop\n", serveData.Addr)
-		server.ListenAndServe(serveData.Addr)
+		server.ListenAndServe(serveData.Addr, serveData.Options)
 	},
 }
 
@@ -36,4 +49,6 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	serveCmd.Flags().StringVarP(&serveData.Addr, "address", "a", ":8989", "Listen address.")
+	serveCmd.Flags().DurationVar(&serveData.Options.ShortExpiry, "short-expires", 24*time.Hour, "How long requests made by the short flow stay valid.")
+	serveCmd.Flags().StringVar(&serveData.Padding, "padding", data.DefaultPadding.String(), "How to pad responses that do not choose for themselves: none, padme or power2.")
 }
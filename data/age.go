@@ -0,0 +1,80 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/Unquabain/ephemeral/envelope"
+)
+
+// ageMagic begins every age file that is not armored.
+const ageMagic = `age-encryption.org/v1`
+
+// IsAge reports whether the start of a file is an age file, armored or not.
+func IsAge(prefix []byte) bool {
+	prefix = bytes.TrimLeft(prefix, " \t\r\n")
+	return bytes.HasPrefix(prefix, []byte(armor.Header)) || bytes.HasPrefix(prefix, []byte(ageMagic))
+}
+
+// AgeRecipient returns the request's key as an age recipient (age1...), so
+// that a responder can encrypt to it with age or rage. Only X25519
+// requests can be age recipients, and hybrid requests cannot, since age
+// would ignore their ML-KEM key.
+func (r PublicRequest) AgeRecipient() (string, error) {
+	if r.Key.Curve() != ecdh.X25519() {
+		return ``, fmt.Errorf(`only x25519 requests can be age recipients`)
+	}
+	if r.KEM != nil {
+		return ``, fmt.Errorf(`hybrid requests cannot be age recipients`)
+	}
+	return envelope.Bech32Encode(`age`, r.Key.Bytes())
+}
+
+// AgeIdentity returns the request's key as an age identity.
+func (r PrivateRequest) AgeIdentity() (*age.X25519Identity, error) {
+	if _, err := r.Public().AgeRecipient(); err != nil {
+		return nil, err
+	}
+	s, err := envelope.Bech32Encode(`AGE-SECRET-KEY-`, r.Key.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Identity(strings.ToUpper(s))
+}
+
+// DecodeAge decrypts an age file, armored or not, that was encrypted to the
+// request's age recipient. The plaintext is authenticated as it is read,
+// so a damaged file is only detected when the damage is reached. Only
+// requests made to be age recipients, with Age set, decode age files;
+// otherwise anyone who saw an ordinary public request could answer it
+// without the signature or expiry that the requester expects.
+func (r PrivateRequest) DecodeAge(ciphertext io.Reader) (io.Reader, error) {
+	if !r.Age {
+		return nil, fmt.Errorf(`request %s was not made to be an age recipient`, r.ID)
+	}
+	identity, err := r.AgeIdentity()
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(ciphertext)
+	prefix, _ := buffered.Peek(len(armor.Header) + 64)
+	ciphertext = buffered
+	if bytes.HasPrefix(bytes.TrimLeft(prefix, " \t\r\n"), []byte(armor.Header)) {
+		ciphertext = armor.NewReader(buffered)
+	}
+	plaintext, err := age.Decrypt(ciphertext, identity)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, fmt.Errorf(`this age file was not encrypted to request %s`, r.ID)
+	} else if err != nil {
+		return nil, fmt.Errorf(`unable to decrypt age file: %w`, err)
+	}
+	return plaintext, nil
+}
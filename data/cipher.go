@@ -2,18 +2,104 @@ package data
 
 import (
 	"bytes"
-	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
-	"github.com/apex/log"
+	"github.com/google/uuid"
 )
 
 const keySize = 32
 
-func cipherFromKeys(private PrivateKey, public PublicKey) (cipher.Block, error) {
+// kdfLabel separates keys derived by this protocol from any other use of
+// the same shared secret. It changes whenever the derivation does.
+const kdfLabel = `ephemeral response key v2`
+
+// ErrCorrupt is returned when an authenticated response fails to decrypt. This
+// means the response was altered in transit, was damaged when it was copied, or
+// was not encrypted for this request.
+var ErrCorrupt = errors.New(`response has been tampered with or is corrupt`)
+
+// keyContext is everything a derived key is bound to besides the shared
+// secret itself. A response made for one request cannot be opened in the
+// context of another.
+type keyContext struct {
+	ID        uuid.UUID
+	Requester PublicKey
+	Responder PublicKey
+
+	// RequesterKEM and KEMCiphertext are only set for hybrid requests.
+	RequesterKEM  *KEMPublicKey
+	KEMCiphertext []byte
+
+	// Expires is only set for requests that expire. Binding it to the key
+	// means that a response to a request with an altered expiry time cannot
+	// be decoded.
+	Expires time.Time
+}
+
+// info serializes the context unambiguously for use as the HKDF info
+// parameter.
+func (c keyContext) info() (string, error) {
+	buff := new(bytes.Buffer)
+	buff.WriteString(kdfLabel)
+	buff.Write(c.ID[:])
+	for _, key := range []PublicKey{c.Requester, c.Responder} {
+		b, err := key.MarshalBinary()
+		if err != nil {
+			return ``, fmt.Errorf(`unable to marshal key for context: %w`, err)
+		}
+		writeField(buff, b)
+	}
+	if c.RequesterKEM != nil {
+		buff.WriteString(`ML-KEM-768`)
+		writeField(buff, c.RequesterKEM.Bytes())
+		writeField(buff, c.KEMCiphertext)
+	}
+	if !c.Expires.IsZero() {
+		buff.WriteString(`expires`)
+		binary.Write(buff, binary.BigEndian, c.Expires.Unix())
+	}
+	return buff.String(), nil
+}
+
+func writeField(buff *bytes.Buffer, b []byte) {
+	binary.Write(buff, binary.BigEndian, uint16(len(b)))
+	buff.Write(b)
+}
+
+// writeLongField is like writeField, for fields that may be longer than
+// 64KiB, such as descriptions and ciphertexts.
+func writeLongField(buff *bytes.Buffer, b []byte) {
+	binary.Write(buff, binary.BigEndian, uint32(len(b)))
+	buff.Write(b)
+}
+
+// deriveKey runs the shared secret through HKDF-SHA256, bound to the given
+// context, and returns an AES-256 key. For hybrid requests, secret is the
+// ECDH secret followed by the ML-KEM secret.
+func deriveKey(secret []byte, ctx keyContext) ([]byte, error) {
+	info, err := ctx.info()
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, secret, nil, info, keySize)
+	if err != nil {
+		return nil, fmt.Errorf(`unable to derive key from secret: %w`, err)
+	}
+	return key, nil
+}
+
+// legacyKey folds the shared secret into a key the way responses before
+// HKDFGCM did. It is only used to decode those responses.
+func legacyKey(private PrivateKey, public PublicKey) ([]byte, error) {
 	secret, err := private.Secret(public)
 	if err != nil {
 		return nil, fmt.Errorf(`unable to create shared secret: %w`, err)
@@ -25,33 +111,76 @@ func cipherFromKeys(private PrivateKey, public PublicKey) (cipher.Block, error)
 	for i, b := range secret {
 		key[i%keySize] = key[i%keySize] ^ b
 	}
-	log.Debugf(`%X`, key)
-	cipher, err := aes.NewCipher(key)
+	return key, nil
+}
+
+// commitmentLabel separates key commitments from any other use of a key.
+const commitmentLabel = `ephemeral key commitment v1`
+
+// commit returns a value that identifies key without revealing it. AES-GCM
+// alone does not commit to its key: a ciphertext can be made that decrypts
+// under two different keys. Checking the commitment before decrypting rules
+// that out.
+func commit(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(commitmentLabel))
+	return mac.Sum(nil)
+}
+
+// checkCommitment returns ErrCorrupt if commitment was not made with key.
+// Responses of the versions made before key commitment may have none, and
+// are then not checked. Every later response is made with one, so if it is
+// missing, it was stripped.
+func checkCommitment(version ResponseVersion, key, commitment []byte) error {
+	if len(commitment) == 0 && (version == LegacyOFB || version == AESGCM) {
+		return nil
+	}
+	if !hmac.Equal(commit(key), commitment) {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// seal encrypts and authenticates data with AES-GCM. The random nonce is
+// prepended to the ciphertext, and additional is authenticated but not
+// encrypted.
+func seal(data, additional []byte, block cipher.Block) ([]byte, error) {
+	aead, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, fmt.Errorf(`unable to create cypher from secret: %w`, err)
+		return nil, fmt.Errorf(`could not create GCM cipher: %w`, err)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf(`could not create random nonce: %w`, err)
 	}
-	return cipher, nil
+	return aead.Seal(nonce, nonce, data, additional), nil
 }
 
-func encrypt(data []byte, block cipher.Block) ([]byte, error) {
-	iv := make([]byte, block.BlockSize())
-	if _, err := rand.Read(iv); err != nil {
-		return nil, fmt.Errorf(`could not create random IV: %w`, err)
+// open reverses seal. It returns ErrCorrupt if the ciphertext or the
+// additional data have been altered.
+func open(data, additional []byte, block cipher.Block) ([]byte, error) {
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf(`could not create GCM cipher: %w`, err)
 	}
-	out := new(bytes.Buffer)
-	if _, err := out.Write(iv); err != nil {
-		return nil, fmt.Errorf(`could not write IV to writer %w`, err)
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrCorrupt
 	}
-	stream := cipher.NewOFB(block, iv)
-	writer := &cipher.StreamWriter{S: stream, W: out}
-	if _, err := io.Copy(writer, bytes.NewReader(data)); err != nil {
-		return nil, fmt.Errorf(`could not encrypt data to writer: %w`, err)
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, data, additional)
+	if err != nil {
+		return nil, ErrCorrupt
 	}
-	return out.Bytes(), nil
+	return plaintext, nil
 }
 
-func decrypt(data []byte, block cipher.Block) ([]byte, error) {
+// decryptOFB decrypts the unauthenticated AES-OFB payloads of LegacyOFB
+// responses. Nothing encrypts this way any more.
+func decryptOFB(data []byte, block cipher.Block) ([]byte, error) {
 	blockSize := block.BlockSize()
+	if len(data) < blockSize {
+		return nil, ErrCorrupt
+	}
 	iv := data[:blockSize]
 	data = data[blockSize:]
 	stream := cipher.NewOFB(block, iv)
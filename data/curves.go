@@ -3,6 +3,8 @@ package data
 import (
 	"crypto/ecdh"
 	"crypto/rand"
+	"fmt"
+	"strings"
 
 	"github.com/apex/log"
 )
@@ -20,17 +22,31 @@ const (
 	// P521 is the P256 elliptic curve
 	P521
 
+	// X25519 is Curve25519 used for Diffie-Hellman. Its keys are much shorter
+	// than those of the NIST curves.
+	X25519
+
 	// InvalidCurve is a constant indicating an error choosing a random curve.
 	InvalidCurve
 )
 
-// RandomCurve selects a supported, secure elliptic curve at random.
-func RandomCurve() ecdh.Curve {
-	b := make([]byte, 1)
-	if _, err := rand.Read(b); err != nil {
-		log.WithError(err).Fatal(`unable to read a random byte`)
+var curveNames = map[Curve]string{
+	P256:   `p256`,
+	P384:   `p384`,
+	P521:   `p521`,
+	X25519: `x25519`,
+}
+
+// String returns the name by which the curve is selected on the command line.
+func (c Curve) String() string {
+	if name, ok := curveNames[c]; ok {
+		return name
 	}
-	c := Curve(b[0]) % InvalidCurve
+	return `invalid`
+}
+
+// ECDH returns the implementation of the curve.
+func (c Curve) ECDH() ecdh.Curve {
 	switch c {
 	case P256:
 		return ecdh.P256()
@@ -38,6 +54,45 @@ func RandomCurve() ecdh.Curve {
 		return ecdh.P384()
 	case P521:
 		return ecdh.P521()
+	case X25519:
+		return ecdh.X25519()
+	}
+	return nil
+}
+
+// curveName returns the name of an implementation of one of the curves.
+func curveName(curve ecdh.Curve) string {
+	for c, n := range curveNames {
+		if c.ECDH() == curve {
+			return n
+		}
+	}
+	return Curve(InvalidCurve).String()
+}
+
+// ParseCurve looks up a curve by name. An empty name or "random" selects
+// a curve at random.
+func ParseCurve(name string) (ecdh.Curve, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == `` || name == `random` {
+		return RandomCurve(), nil
+	}
+	for c, n := range curveNames {
+		if n == name {
+			return c.ECDH(), nil
+		}
+	}
+	return nil, fmt.Errorf(`unknown curve %q`, name)
+}
+
+// RandomCurve selects a supported, secure elliptic curve at random.
+func RandomCurve() ecdh.Curve {
+	b := make([]byte, 1)
+	if _, err := rand.Read(b); err != nil {
+		log.WithError(err).Fatal(`unable to read a random byte`)
+	}
+	if c := (Curve(b[0]) % InvalidCurve).ECDH(); c != nil {
+		return c
 	}
 	log.Fatal(`read unreadable random byte`)
 	return nil
@@ -2,13 +2,45 @@ package data_test
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"os"
 	"testing"
+	"time"
 
+	"filippo.io/age"
+	"filippo.io/age/armor"
 	"github.com/Unquabain/ephemeral/data"
+	"github.com/Unquabain/ephemeral/envelope"
+	"github.com/Unquabain/ephemeral/wire"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
 )
 
+func openFixture(t *testing.T, name string, target any) {
+	t.Helper()
+	var env envelope.Envelope
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := env.ReadFrom(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Open(target); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestPrivateRequestMarshal(t *testing.T) {
 	assert := assert.New(t)
 	request, err := data.NewRequest(``)
@@ -64,3 +96,879 @@ proof by vigorous handwaving:
 	assert.Equal(decrypted, message)
 
 }
+
+func TestCurves(t *testing.T) {
+	for _, c := range []data.Curve{data.P256, data.P384, data.P521, data.X25519} {
+		t.Run(c.String(), func(t *testing.T) {
+			assert := assert.New(t)
+			curve, err := data.ParseCurve(c.String())
+			assert.NoError(err)
+			request, err := data.NewCurveRequest(``, curve)
+			assert.NoError(err)
+
+			var (
+				private data.PrivateRequest
+				public  data.PublicRequest
+				encoded = new(bytes.Buffer)
+			)
+			assert.NoError(gob.NewEncoder(encoded).Encode(request))
+			assert.NoError(gob.NewDecoder(encoded).Decode(&private))
+			assert.NoError(gob.NewEncoder(encoded).Encode(request.Public()))
+			assert.NoError(gob.NewDecoder(encoded).Decode(&public))
+			assert.True(request.Key.Equal(private.Key))
+
+			text, err := public.Key.MarshalText()
+			assert.NoError(err)
+			var key data.PublicKey
+			assert.NoError(key.UnmarshalText(text))
+			assert.True(public.Key.Equal(key))
+
+			encrypted, err := public.Encode([]byte(`Attack at dawn.`))
+			assert.NoError(err)
+			decrypted, err := private.Decode(encrypted)
+			assert.NoError(err)
+			assert.Equal([]byte(`Attack at dawn.`), decrypted)
+		})
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		private  data.PrivateRequest
+		public   data.PublicRequest
+		response data.Response
+		encoded  = new(bytes.Buffer)
+	)
+	request, err := data.NewRequest(``)
+	assert.NoError(err)
+	assert.NoError(request.MakeHybrid())
+	assert.NoError(gob.NewEncoder(encoded).Encode(request))
+	assert.NoError(gob.NewDecoder(encoded).Decode(&private))
+	assert.NoError(gob.NewEncoder(encoded).Encode(request.Public()))
+	assert.NoError(gob.NewDecoder(encoded).Decode(&public))
+	assert.True(private.Hybrid())
+	assert.NotNil(public.KEM)
+
+	encrypted, err := public.Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	assert.NotEmpty(encrypted.KEMCiphertext)
+	assert.NoError(gob.NewEncoder(encoded).Encode(encrypted))
+	assert.NoError(gob.NewDecoder(encoded).Decode(&response))
+
+	decrypted, err := private.Decode(response)
+	assert.NoError(err)
+	assert.Equal([]byte(`Attack at dawn.`), decrypted)
+
+	public.KEM = nil
+	downgraded, err := public.Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	_, err = private.Decode(downgraded)
+	assert.Error(err)
+}
+
+func TestGroupRequest(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		members  []data.PrivateRequest
+		publics  []data.PublicRequest
+		group    data.GroupRequest
+		response data.Response
+		encoded  = new(bytes.Buffer)
+	)
+	for i := 0; i < 3; i++ {
+		request, err := data.NewRequest(``)
+		assert.NoError(err)
+		members = append(members, request)
+		publics = append(publics, request.Public())
+	}
+	assert.NoError(members[2].MakeHybrid())
+	publics[2] = members[2].Public()
+
+	created, err := data.NewGroupRequest(`On call`, append(publics, publics[0])...)
+	assert.NoError(err)
+	assert.Len(created.Members, 3)
+	assert.NoError(gob.NewEncoder(encoded).Encode(created))
+	assert.NoError(gob.NewDecoder(encoded).Decode(&group))
+
+	encrypted, err := group.Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	assert.NoError(gob.NewEncoder(encoded).Encode(encrypted))
+	assert.NoError(gob.NewDecoder(encoded).Decode(&response))
+
+	for _, member := range members {
+		decrypted, err := member.Decode(response)
+		assert.NoError(err)
+		assert.Equal([]byte(`Attack at dawn.`), decrypted)
+	}
+
+	outsider, err := data.NewRequest(``)
+	assert.NoError(err)
+	_, err = outsider.Decode(response)
+	assert.Error(err)
+}
+
+func TestSignedRequest(t *testing.T) {
+	var (
+		assert  = assert.New(t)
+		public  data.PublicRequest
+		encoded = new(bytes.Buffer)
+	)
+	identity, err := data.NewIdentity(`Alice`)
+	assert.NoError(err)
+	request, err := data.NewRequest(`Database password`)
+	assert.NoError(err)
+
+	unsigned := request.Public()
+	signer, err := unsigned.Verify()
+	assert.NoError(err)
+	assert.Nil(signer)
+
+	signed := request.Public()
+	assert.NoError(signed.Sign(identity))
+	assert.NoError(gob.NewEncoder(encoded).Encode(signed))
+	assert.NoError(gob.NewDecoder(encoded).Decode(&public))
+	signer, err = public.Verify()
+	assert.NoError(err)
+	assert.True(signer.Is(identity.Public()))
+	assert.Equal(`Alice`, signer.Name)
+
+	parsed, err := data.ParseSignerKey(signer.KeyString())
+	assert.NoError(err)
+	assert.True(parsed.Is(identity.Public()))
+
+	public.Description = `Production database password`
+	_, err = public.Verify()
+	assert.ErrorIs(err, data.ErrBadSignature)
+
+	substitute, err := data.NewRequest(`Database password`)
+	assert.NoError(err)
+	forged := substitute.Public()
+	forged.Signer, forged.Signature = signed.Signer, signed.Signature
+	_, err = forged.Verify()
+	assert.ErrorIs(err, data.ErrBadSignature)
+}
+
+func TestSignedResponse(t *testing.T) {
+	var (
+		assert   = assert.New(t)
+		response data.Response
+		encoded  = new(bytes.Buffer)
+		message  = []byte(`Attack at dawn.`)
+	)
+	identity, err := data.NewIdentity(`Bob`)
+	assert.NoError(err)
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+	group, err := data.NewGroupRequest(``, private.Public())
+	assert.NoError(err)
+
+	for _, encoder := range []data.Encoder{private.Public(), group} {
+		signed, err := encoder.Encode(message)
+		assert.NoError(err)
+		assert.NoError(signed.Sign(identity))
+		assert.NoError(gob.NewEncoder(encoded).Encode(signed))
+		response = data.Response{}
+		assert.NoError(gob.NewDecoder(encoded).Decode(&response))
+
+		decrypted, signer, err := private.DecodeSigned(response)
+		assert.NoError(err)
+		assert.Equal(message, decrypted)
+		assert.True(signer.Is(identity.Public()))
+
+		if len(response.Recipients) > 0 {
+			response.Recipients[0].Data[0] ^= 1
+		} else {
+			response.Data[0] ^= 1
+		}
+		_, _, err = private.DecodeSigned(response)
+		assert.ErrorIs(err, data.ErrBadSignature)
+	}
+}
+
+func TestEncryptedPrivateRequest(t *testing.T) {
+	var (
+		assert    = assert.New(t)
+		encrypted data.EncryptedPrivateRequest
+		encoded   = new(bytes.Buffer)
+	)
+	request, err := data.NewRequest(`Database password`)
+	assert.NoError(err)
+	assert.NoError(request.MakeHybrid())
+
+	created, err := request.Encrypt([]byte(`correct horse battery staple`))
+	assert.NoError(err)
+	assert.NoError(gob.NewEncoder(encoded).Encode(created))
+	assert.NoError(gob.NewDecoder(encoded).Decode(&encrypted))
+
+	decrypted, err := encrypted.Decrypt([]byte(`correct horse battery staple`))
+	assert.NoError(err)
+	assert.Equal(request.ID, decrypted.ID)
+	assert.True(request.Key.Equal(decrypted.Key))
+	assert.True(decrypted.Hybrid())
+
+	_, err = encrypted.Decrypt([]byte(`Tr0ub4dor&3`))
+	assert.ErrorIs(err, data.ErrPassphrase)
+
+	encrypted.Description = `Something else`
+	_, err = encrypted.Decrypt([]byte(`correct horse battery staple`))
+	assert.ErrorIs(err, data.ErrPassphrase)
+
+	// A doctored file cannot make the decrypter work without end. The limits
+	// are checked before any work is done.
+	for _, doctor := range []func(*data.EncryptedPrivateRequest){
+		func(e *data.EncryptedPrivateRequest) { e.Time = 1 << 20 },
+		func(e *data.EncryptedPrivateRequest) { e.Memory = 1 << 30 },
+		func(e *data.EncryptedPrivateRequest) { e.Threads = 255 },
+	} {
+		doctored := created
+		doctor(&doctored)
+		_, err = doctored.Decrypt([]byte(`correct horse battery staple`))
+		assert.ErrorContains(err, `more than the limit`)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	assert := assert.New(t)
+	identity, err := data.NewIdentity(``)
+	assert.NoError(err)
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+	private.ExpireAfter(time.Hour)
+	public := private.Public()
+	assert.NoError(public.Sign(identity))
+	assert.False(public.Expired(time.Now()))
+	assert.True(public.Expired(time.Now().Add(2 * time.Hour)))
+
+	encrypted, err := public.Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	assert.False(private.Late(encrypted))
+	_, err = private.Decode(encrypted)
+	assert.NoError(err)
+
+	encrypted.Created = encrypted.Created.Add(2 * time.Hour)
+	assert.True(private.Late(encrypted))
+	_, err = private.Decode(encrypted)
+	assert.ErrorIs(err, data.ErrCorrupt)
+
+	extended := public
+	extended.Expires = extended.Expires.Add(24 * time.Hour)
+	_, err = extended.Verify()
+	assert.ErrorIs(err, data.ErrBadSignature)
+	encrypted, err = extended.Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	_, err = private.Decode(encrypted)
+	assert.ErrorIs(err, data.ErrCorrupt)
+}
+
+func TestDecodeTampered(t *testing.T) {
+	assert := assert.New(t)
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+
+	encrypted, err := private.Public().Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	encrypted.Data[len(encrypted.Data)-1] ^= 1
+
+	_, err = private.Decode(encrypted)
+	assert.ErrorIs(err, data.ErrCorrupt)
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version data.ResponseVersion
+	}{
+		{`legacy`, data.LegacyOFB},
+		{`gcm`, data.AESGCM},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				assert   = assert.New(t)
+				private  data.PrivateRequest
+				response data.Response
+			)
+			openFixture(t, `testdata/`+tc.name+`_private.txt`, &private)
+			openFixture(t, `testdata/`+tc.name+`_response.txt`, &response)
+			assert.Equal(tc.version, response.Version)
+
+			decrypted, err := private.Decode(response)
+			assert.NoError(err)
+			assert.Equal([]byte("The magic words are squeamish ossifrage.\n"), decrypted)
+		})
+	}
+}
+
+func TestDecodeReplayed(t *testing.T) {
+	assert := assert.New(t)
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+	encrypted, err := private.Public().Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+
+	other := private
+	other.ID = uuid.New()
+	encrypted.ID = other.ID
+	_, err = other.Decode(encrypted)
+	assert.ErrorIs(err, data.ErrCorrupt)
+}
+
+func TestEncodeStream(t *testing.T) {
+	private, err := data.NewRequest(``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := data.NewRequest(``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := data.NewGroupRequest(``, private.Public(), member.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sizes around the segment boundary, where the last segment is full or
+	// empty.
+	for _, size := range []int{0, 1, 64*1024 - 1, 64 * 1024, 64*1024 + 1, 200 * 1024} {
+		for _, encoder := range []data.Encoder{private.Public(), group} {
+			assert := assert.New(t)
+			message := make([]byte, size)
+			for i := range message {
+				message[i] = byte(i * 7)
+			}
+			stream := new(bytes.Buffer)
+			header, w, err := encoder.EncodeStream(stream)
+			assert.NoError(err)
+			_, err = w.Write(message)
+			assert.NoError(err)
+			assert.NoError(w.Close())
+			assert.Equal(data.HKDFStream, header.Version)
+
+			_, err = private.Decode(header)
+			assert.Error(err, `streamed responses cannot be decoded whole`)
+
+			r, _, err := private.DecodeStream(header, bytes.NewReader(stream.Bytes()))
+			assert.NoError(err)
+			decrypted, err := io.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(message, decrypted, `size %d`, size)
+
+			if size == 0 {
+				continue
+			}
+			tampered := bytes.Clone(stream.Bytes())
+			tampered[len(tampered)/2] ^= 1
+			r, _, err = private.DecodeStream(header, bytes.NewReader(tampered))
+			assert.NoError(err)
+			_, err = io.ReadAll(r)
+			assert.ErrorIs(err, data.ErrCorrupt)
+
+			// Dropping the last segment leaves a stream that ends with a
+			// middle segment.
+			if size > 64*1024 {
+				r, _, err = private.DecodeStream(header, bytes.NewReader(stream.Bytes()[:64*1024+16]))
+				assert.NoError(err)
+				_, err = io.ReadAll(r)
+				assert.ErrorIs(err, data.ErrCorrupt)
+			}
+		}
+	}
+}
+
+func TestDecodeMismatch(t *testing.T) {
+	assert := assert.New(t)
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+	other, err := data.NewRequest(``)
+	assert.NoError(err)
+	encrypted, err := private.Public().Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+
+	var mismatch *data.MismatchError
+	_, err = other.Decode(encrypted)
+	if assert.ErrorAs(err, &mismatch) {
+		assert.Equal(private.ID, mismatch.Response)
+		assert.Equal(other.ID, mismatch.Request)
+		assert.Equal(`this response was made for request `+private.ID.String()+`, not `+other.ID.String(), err.Error())
+	}
+
+	group, err := data.NewGroupRequest(``, private.Public())
+	assert.NoError(err)
+	encrypted, err = group.Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	_, err = other.Decode(encrypted)
+	if assert.ErrorAs(err, &mismatch) {
+		assert.Equal(group.ID, mismatch.Response)
+	}
+
+	// A response for another request is passed over as one, even if its
+	// signature does not match.
+	identity, err := data.NewIdentity(`Mallory`)
+	assert.NoError(err)
+	encrypted, err = private.Public().Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	assert.NoError(encrypted.Sign(identity))
+	encrypted.Signature[0] ^= 1
+	_, err = other.Decode(encrypted)
+	assert.ErrorAs(err, &mismatch)
+	_, err = private.Decode(encrypted)
+	assert.ErrorIs(err, data.ErrBadSignature)
+
+	stream := new(bytes.Buffer)
+	header, w, err := private.Public().EncodeStream(stream)
+	assert.NoError(err)
+	assert.NoError(w.Close())
+	assert.NoError(header.Sign(identity))
+	header.Signature[0] ^= 1
+	_, _, err = other.DecodeStream(header, stream)
+	assert.ErrorAs(err, &mismatch)
+}
+
+func TestKeyCommitment(t *testing.T) {
+	assert := assert.New(t)
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+	encrypted, err := private.Public().Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	assert.NotEmpty(encrypted.Commitment)
+
+	encrypted.Commitment[0] ^= 1
+	_, err = private.Decode(encrypted)
+	assert.ErrorIs(err, data.ErrCorrupt)
+
+	// Every response of this version is made with a commitment, so one that
+	// has none had it stripped. Older versions without one are still read,
+	// as TestDecodeLegacy shows.
+	encrypted.Commitment = nil
+	_, err = private.Decode(encrypted)
+	assert.ErrorIs(err, data.ErrCorrupt)
+
+	stream := new(bytes.Buffer)
+	header, w, err := private.Public().EncodeStream(stream)
+	assert.NoError(err)
+	assert.NoError(w.Close())
+	header.Commitment = nil
+	_, _, err = private.DecodeStream(header, stream)
+	assert.ErrorIs(err, data.ErrCorrupt)
+}
+
+func TestFields(t *testing.T) {
+	assert := assert.New(t)
+	fields := data.Fields{
+		{Name: `user`, Type: data.TextField, Value: []byte(`admin`)},
+		{Name: `password`, Type: data.SecretField, Value: []byte(`hunter2`)},
+		{Name: `ca`, Type: data.FileField, Value: []byte{0xff, 0x00, 0x01}, Filename: `ca.der`},
+	}
+	plaintext, err := fields.MarshalBinary()
+	assert.NoError(err)
+
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+	encrypted, err := private.Public().EncodeContent(plaintext, data.FieldsContent, data.DefaultPadding)
+	assert.NoError(err)
+	assert.Equal(data.FieldsContent, encrypted.Content)
+	decrypted, err := private.Decode(encrypted)
+	assert.NoError(err)
+
+	var recovered data.Fields
+	assert.NoError(recovered.UnmarshalBinary(decrypted))
+	assert.Equal(fields, recovered)
+
+	// What the secret is cannot be changed without it being noticed.
+	tampered := encrypted
+	tampered.Content = data.RawContent
+	_, err = private.Decode(tampered)
+	assert.ErrorIs(err, data.ErrCorrupt)
+
+	// A plain secret stays plain, whatever it begins with.
+	encrypted, err = private.Public().Encode(plaintext)
+	assert.NoError(err)
+	assert.Equal(data.RawContent, encrypted.Content)
+	password, ok := recovered.Get(`password`)
+	assert.True(ok)
+	assert.Equal(`hunter2`, password.String())
+	_, ok = recovered.Get(`host`)
+	assert.False(ok)
+
+	// Binary values survive JSON.
+	j, err := json.Marshal(fields)
+	assert.NoError(err)
+	recovered = nil
+	assert.NoError(json.Unmarshal(j, &recovered))
+	assert.Equal(fields, recovered)
+
+	_, err = append(fields, fields[0]).MarshalBinary()
+	assert.Error(err, `duplicate names are refused`)
+	_, err = data.ParseFieldType(`password`)
+	assert.Error(err)
+}
+
+func TestFingerprint(t *testing.T) {
+	assert := assert.New(t)
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+	fingerprint, err := private.Fingerprint()
+	assert.NoError(err)
+	assert.Regexp(`^\d{4} \d{4} \d{4}$`, fingerprint.Code())
+	assert.Regexp(`^SHA256:[A-Za-z0-9+/]{43}$`, fingerprint.String())
+
+	// The prelude shows the code, and when the request expires.
+	prelude, err := private.Prelude()
+	assert.NoError(err)
+	assert.Contains(prelude, `Verification code: `+fingerprint.Code())
+	assert.NotContains(prelude, `Expires`)
+	private.ExpireAfter(time.Hour)
+	prelude, err = private.Prelude()
+	assert.NoError(err)
+	assert.Contains(prelude, `Expires `+private.Expires.Local().Format(time.RFC1123))
+
+	// The fingerprint survives the public request being sent.
+	env := envelope.Envelope{Name: `PUBLIC REQUEST`}
+	assert.NoError(env.Stuff(private.Public()))
+	var public data.PublicRequest
+	assert.NoError(env.Open(&public))
+	recovered, err := public.Fingerprint()
+	assert.NoError(err)
+	assert.Equal(fingerprint, recovered)
+
+	// It changes if the key is swapped, or the ID is.
+	other, err := data.NewRequest(``)
+	assert.NoError(err)
+	swapped := public
+	swapped.Key = other.Public().Key
+	changed, err := swapped.Fingerprint()
+	assert.NoError(err)
+	assert.NotEqual(fingerprint, changed)
+	swapped = public
+	swapped.ID = other.ID
+	changed, err = swapped.Fingerprint()
+	assert.NoError(err)
+	assert.NotEqual(fingerprint, changed)
+
+	assert.NoError(private.MakeHybrid())
+	hybrid, err := private.Fingerprint()
+	assert.NoError(err)
+	assert.NotEqual(fingerprint, hybrid)
+}
+
+func TestPadding(t *testing.T) {
+	private, err := data.NewRequest(``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, err := data.NewRequest(``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := data.NewGroupRequest(``, private.Public(), member.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		padding data.Padding
+		same    [2]int
+		differ  [2]int
+	}{
+		{data.NoPadding, [2]int{10, 10}, [2]int{10, 11}},
+		{data.Padme, [2]int{10, 50}, [2]int{63, 64}},
+		{data.Padme, [2]int{1000, 1023}, [2]int{1023, 1024}},
+		{data.PowerOfTwo, [2]int{100, 127}, [2]int{127, 128}},
+	} {
+		for _, encoder := range []data.Encoder{private.Public(), group} {
+			t.Run(tc.padding.String(), func(t *testing.T) {
+				assert := assert.New(t)
+				size := func(n int) int {
+					secret := bytes.Repeat([]byte{'x'}, n)
+					encrypted, err := encoder.EncodePadded(secret, tc.padding)
+					assert.NoError(err)
+					assert.Equal(tc.padding != data.NoPadding, encrypted.Padded)
+					decrypted, err := private.Decode(encrypted)
+					assert.NoError(err)
+					assert.Equal(secret, decrypted)
+					return len(encrypted.Data)
+				}
+				assert.Equal(size(tc.same[0]), size(tc.same[1]))
+				assert.NotEqual(size(tc.differ[0]), size(tc.differ[1]))
+			})
+		}
+	}
+
+	parsed, err := data.ParsePadding(`Power2`)
+	assert.NoError(t, err)
+	assert.Equal(t, data.PowerOfTwo, parsed)
+	_, err = data.ParsePadding(`lots`)
+	assert.Error(t, err)
+}
+
+func TestPaddingStripped(t *testing.T) {
+	assert := assert.New(t)
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+	encrypted, err := private.Public().Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	assert.True(encrypted.Padded)
+
+	// Claiming the padding is part of the secret is detected.
+	encrypted.Padded = false
+	_, err = private.Decode(encrypted)
+	assert.ErrorIs(err, data.ErrCorrupt)
+}
+
+func TestSplit(t *testing.T) {
+	assert := assert.New(t)
+	secret := []byte(`correct horse battery staple`)
+	shares, err := data.Split(secret, 5, 3)
+	assert.NoError(err)
+	assert.Len(shares, 5)
+
+	for _, picked := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var some []data.Share
+		for _, i := range picked {
+			some = append(some, shares[i])
+		}
+		combined, err := data.Combine(some)
+		assert.NoError(err)
+		assert.Equal(secret, combined)
+	}
+
+	_, err = data.Combine(shares[:2])
+	assert.ErrorContains(err, `3 shares are needed`)
+	assert.ErrorIs(err, data.ErrTooFewShares)
+
+	// Shares survive being sent in a response.
+	private, err := data.NewRequest(``)
+	assert.NoError(err)
+	plaintext, err := shares[0].MarshalBinary()
+	assert.NoError(err)
+	encrypted, err := private.Public().EncodeContent(plaintext, data.ShareContent, data.DefaultPadding)
+	assert.NoError(err)
+	assert.Equal(data.ShareContent, encrypted.Content)
+	decrypted, err := private.Decode(encrypted)
+	assert.NoError(err)
+	var share data.Share
+	assert.NoError(share.UnmarshalBinary(decrypted))
+	assert.Equal(shares[0], share)
+
+	_, err = data.Split(secret, 3, 4)
+	assert.Error(err)
+	_, err = data.Split(secret, 3, 1)
+	assert.Error(err)
+
+	// What the secret is goes along with its shares.
+	shares, err = data.SplitContent(secret, data.FieldsContent, 3, 2)
+	assert.NoError(err)
+	combined, err := data.Combine(shares[:2])
+	assert.NoError(err)
+	assert.Equal(secret, combined)
+	assert.Equal(data.FieldsContent, shares[0].Content)
+	shares[1].Content = data.RawContent
+	assert.ErrorIs(shares[1].Check(), data.ErrCorrupt)
+}
+
+func TestSplitDamaged(t *testing.T) {
+	assert := assert.New(t)
+	secret := []byte(`correct horse battery staple`)
+	shares, err := data.Split(secret, 3, 2)
+	assert.NoError(err)
+
+	damaged := shares[1]
+	damaged.Value = bytes.Clone(damaged.Value)
+	damaged.Value[0] ^= 1
+	_, err = data.Combine([]data.Share{shares[0], damaged})
+	assert.ErrorIs(err, data.ErrCorrupt)
+
+	// A damaged share is refused as soon as it is read.
+	plaintext, err := damaged.MarshalBinary()
+	assert.NoError(err)
+	assert.ErrorIs(new(data.Share).UnmarshalBinary(plaintext), data.ErrCorrupt)
+
+	others, err := data.Split(secret, 3, 2)
+	assert.NoError(err)
+	_, err = data.Combine([]data.Share{shares[0], others[1]})
+	assert.ErrorIs(err, data.ErrMixedShares)
+
+	// A share cannot stand in for the secret by claiming that it is enough
+	// on its own, nor claim more shares than there can be.
+	for _, claim := range [][2]int{{1, 1}, {0, 3}, {2, 256}, {4, 3}} {
+		forged := shares[0]
+		forged.Threshold, forged.Total = claim[0], claim[1]
+		_, err = data.Combine([]data.Share{forged})
+		assert.ErrorIs(err, data.ErrCorrupt)
+		assert.ErrorContains(err, `need 2 <= threshold`)
+	}
+}
+
+func TestAge(t *testing.T) {
+	assert := assert.New(t)
+	private, err := data.NewCurveRequest(``, data.X25519.ECDH())
+	assert.NoError(err)
+	private.Age = true
+	recipient, err := private.Public().AgeRecipient()
+	assert.NoError(err)
+	assert.Regexp(`^age1[02-9ac-hj-np-z]{58}$`, recipient)
+	identity, err := private.AgeIdentity()
+	assert.NoError(err)
+	assert.Equal(recipient, identity.Recipient().String())
+
+	// A responder encrypts with age itself.
+	parsed, err := age.ParseX25519Recipient(recipient)
+	assert.NoError(err)
+	buff := new(bytes.Buffer)
+	armored := armor.NewWriter(buff)
+	w, err := age.Encrypt(armored, parsed)
+	assert.NoError(err)
+	_, err = io.WriteString(w, `Attack at dawn.`)
+	assert.NoError(err)
+	assert.NoError(w.Close())
+	assert.NoError(armored.Close())
+	assert.True(data.IsAge(buff.Bytes()))
+
+	plaintext, err := private.DecodeAge(bytes.NewReader(buff.Bytes()))
+	assert.NoError(err)
+	decrypted, err := io.ReadAll(plaintext)
+	assert.NoError(err)
+	assert.Equal([]byte(`Attack at dawn.`), decrypted)
+
+	// A request not made to be an age recipient refuses age files, even if
+	// its key could decrypt them.
+	private.Age = false
+	_, err = private.DecodeAge(bytes.NewReader(buff.Bytes()))
+	assert.ErrorContains(err, `not made to be an age recipient`)
+
+	other, err := data.NewCurveRequest(``, data.X25519.ECDH())
+	assert.NoError(err)
+	other.Age = true
+	_, err = other.DecodeAge(bytes.NewReader(buff.Bytes()))
+	assert.ErrorContains(err, `not encrypted to request`)
+
+	nist, err := data.NewCurveRequest(``, data.P256.ECDH())
+	assert.NoError(err)
+	_, err = nist.Public().AgeRecipient()
+	assert.Error(err)
+}
+
+func TestSSH(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]crypto.Signer{`ed25519`: edKey, `ecdsa`: ecKey} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			sshPublic, err := ssh.NewPublicKey(key.Public())
+			assert.NoError(err)
+			authorized := append([]byte("# a comment\n"), ssh.MarshalAuthorizedKey(sshPublic)...)
+			recipients, skipped, err := data.ParseSSHRecipients(authorized)
+			assert.NoError(err)
+			assert.Empty(skipped)
+			assert.Len(recipients, 1)
+
+			encrypted, err := recipients[0].Encode([]byte(`Attack at dawn.`))
+			assert.NoError(err)
+
+			block, err := ssh.MarshalPrivateKeyWithPassphrase(key, ``, []byte(`hunter2`))
+			assert.NoError(err)
+			asked := false
+			private, err := data.SSHPrivateRequest(pem.EncodeToMemory(block), func() ([]byte, error) {
+				asked = true
+				return []byte(`hunter2`), nil
+			})
+			assert.NoError(err)
+			assert.True(asked)
+			decrypted, err := private.Decode(encrypted)
+			assert.NoError(err)
+			assert.Equal([]byte(`Attack at dawn.`), decrypted)
+
+			other, err := data.NewRequest(``)
+			assert.NoError(err)
+			_, err = other.Decode(encrypted)
+			var mismatch *data.MismatchError
+			assert.ErrorAs(err, &mismatch)
+		})
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	assert := assert.New(t)
+	identity, err := data.NewIdentity(`Alice`)
+	assert.NoError(err)
+	private, err := data.NewRequest(`Database password`)
+	assert.NoError(err)
+	private.ExpireAfter(time.Hour)
+	assert.NoError(private.MakeHybrid())
+	public := private.Public()
+	assert.NoError(public.Sign(identity))
+	member, err := data.NewRequest(``)
+	assert.NoError(err)
+	group, err := data.NewGroupRequest(`Oncall`, public, member.Public())
+	assert.NoError(err)
+	encrypted, err := group.Encode([]byte(`Attack at dawn.`))
+	assert.NoError(err)
+	assert.NoError(encrypted.Sign(identity))
+
+	// Everything survives the trip through an envelope in the new format.
+	env := envelope.Envelope{Name: `PUBLIC REQUEST`}
+	assert.NoError(env.Stuff(public))
+	assert.False(wire.IsGob(env.Data))
+	var opened data.PublicRequest
+	assert.NoError(env.Open(&opened))
+	_, err = opened.Verify()
+	assert.NoError(err)
+	assert.True(public.Expires.Equal(opened.Expires))
+
+	env = envelope.Envelope{Name: `PRIVATE REQUEST`}
+	assert.NoError(env.Stuff(private))
+	var reopened data.PrivateRequest
+	assert.NoError(env.Open(&reopened))
+
+	env = envelope.Envelope{Name: `RESPONSE`}
+	assert.NoError(env.Stuff(encrypted))
+	var response data.Response
+	assert.NoError(env.Open(&response))
+	decrypted, signer, err := reopened.DecodeSigned(response)
+	assert.NoError(err)
+	assert.Equal([]byte(`Attack at dawn.`), decrypted)
+	assert.True(signer.Is(identity.Public()))
+
+	// Envelopes from before the new format can still be opened.
+	env = envelope.Envelope{Name: `PUBLIC REQUEST`}
+	assert.NoError(gob.NewEncoder(env.DataWriter()).Encode(public))
+	assert.True(wire.IsGob(env.Data))
+	opened = data.PublicRequest{}
+	assert.NoError(env.Open(&opened))
+	_, err = opened.Verify()
+	assert.NoError(err)
+}
+
+func TestHeaders(t *testing.T) {
+	assert := assert.New(t)
+	request, err := data.NewCurveRequest(`Headers`, data.P384.ECDH())
+	assert.NoError(err)
+	request.ExpireAfter(time.Hour)
+	fingerprint, err := request.Fingerprint()
+	assert.NoError(err)
+
+	headers := request.Public().Headers()
+	assert.Equal(`1`, headers[`Version`])
+	assert.Equal(`p384`, headers[`Curve`])
+	assert.Equal(request.ID.String(), headers[`Request-ID`])
+	assert.Equal(fingerprint.String(), headers[`Fingerprint`])
+	assert.Equal(request.Expires.UTC().Format(time.RFC3339), headers[`Expires`])
+	assert.Equal(headers, request.Headers())
+
+	response, err := request.Public().Encode([]byte(`secret`))
+	assert.NoError(err)
+	assert.Equal(request.ID.String(), response.Headers()[`Request-ID`])
+
+	// Headers survive the envelope.
+	env := envelope.Envelope{Name: `PUBLIC REQUEST`, Headers: headers}
+	assert.NoError(env.Stuff(request.Public()))
+	text, err := env.MarshalText()
+	assert.NoError(err)
+	var recovered envelope.Envelope
+	assert.NoError(recovered.UnmarshalText(text))
+	assert.Equal(headers, recovered.Headers)
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Unquabain/ephemeral/wire"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/argon2"
+)
+
+// ErrPassphrase is returned when an encrypted private request cannot be
+// decrypted. Either the passphrase is wrong, or the file is damaged.
+var ErrPassphrase = errors.New(`wrong passphrase, or the private request is corrupt`)
+
+// Default Argon2id parameters for new encrypted private requests, following
+// the second recommendation of RFC 9106.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	saltSize     = 16
+
+	// The limits stop a doctored file from tying up the CPU and memory of
+	// whoever decrypts it, such as the web server, for as long as it likes.
+	// They are a few times the defaults, to leave room for stronger
+	// settings. Memory is in KiB, like argonMemory.
+	maxArgonTime    = 4 * argonTime
+	maxArgonMemory  = 4 * argonMemory
+	maxArgonThreads = 4 * argonThreads
+)
+
+// EncryptedPrivateRequest is a PrivateRequest sealed under a passphrase, so
+// that it is safe to leave on disk while waiting for the response. The ID
+// and Description are left readable, but cannot be altered without
+// detection.
+type EncryptedPrivateRequest struct {
+	ID          uuid.UUID `cbor:"1,keyasint"`
+	Description string    `cbor:"2,keyasint,omitempty"`
+
+	// Salt and the Argon2id parameters derive the key from the passphrase.
+	Salt    []byte `cbor:"3,keyasint"`
+	Time    uint32 `cbor:"4,keyasint"`
+	Memory  uint32 `cbor:"5,keyasint"`
+	Threads uint8  `cbor:"6,keyasint"`
+
+	// Data is the sealed PrivateRequest.
+	Data []byte `cbor:"7,keyasint"`
+}
+
+func (e EncryptedPrivateRequest) key(passphrase []byte) []byte {
+	return argon2.IDKey(passphrase, e.Salt, e.Time, e.Memory, e.Threads, keySize)
+}
+
+// additional serializes the readable fields, which are authenticated along
+// with the sealed request.
+func (e EncryptedPrivateRequest) additional() []byte {
+	buff := new(bytes.Buffer)
+	buff.Write(e.ID[:])
+	writeLongField(buff, []byte(e.Description))
+	writeField(buff, e.Salt)
+	binary.Write(buff, binary.BigEndian, e.Time)
+	binary.Write(buff, binary.BigEndian, e.Memory)
+	buff.WriteByte(e.Threads)
+	return buff.Bytes()
+}
+
+// Encrypt seals the request under a key derived from the passphrase with
+// Argon2id.
+func (r PrivateRequest) Encrypt(passphrase []byte) (EncryptedPrivateRequest, error) {
+	e := EncryptedPrivateRequest{
+		ID:          r.ID,
+		Description: r.Description,
+		Salt:        make([]byte, saltSize),
+		Time:        argonTime,
+		Memory:      argonMemory,
+		Threads:     argonThreads,
+	}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return e, fmt.Errorf(`could not create random salt: %w`, err)
+	}
+	plaintext, err := wire.Marshal(r)
+	if err != nil {
+		return e, fmt.Errorf(`could not encode private request: %w`, err)
+	}
+	block, err := aes.NewCipher(e.key(passphrase))
+	if err != nil {
+		return e, fmt.Errorf(`unable to create cypher from passphrase: %w`, err)
+	}
+	if e.Data, err = seal(plaintext, e.additional(), block); err != nil {
+		return e, fmt.Errorf(`unable to encrypt private request: %w`, err)
+	}
+	return e, nil
+}
+
+// Decrypt recovers the PrivateRequest with the passphrase it was encrypted
+// under. If the passphrase is wrong, the error is ErrPassphrase.
+func (e EncryptedPrivateRequest) Decrypt(passphrase []byte) (PrivateRequest, error) {
+	var r PrivateRequest
+	if len(e.Salt) == 0 || e.Time == 0 || e.Threads == 0 {
+		return r, fmt.Errorf(`encrypted private request has no key derivation parameters`)
+	}
+	if e.Time > maxArgonTime {
+		return r, fmt.Errorf(`encrypted private request asks for %d passes, more than the limit of %d`, e.Time, maxArgonTime)
+	}
+	if e.Memory > maxArgonMemory {
+		return r, fmt.Errorf(`encrypted private request asks for %d KiB of memory, more than the limit of %d`, e.Memory, maxArgonMemory)
+	}
+	if e.Threads > maxArgonThreads {
+		return r, fmt.Errorf(`encrypted private request asks for %d threads, more than the limit of %d`, e.Threads, maxArgonThreads)
+	}
+	block, err := aes.NewCipher(e.key(passphrase))
+	if err != nil {
+		return r, fmt.Errorf(`unable to create cypher from passphrase: %w`, err)
+	}
+	plaintext, err := open(e.Data, e.additional(), block)
+	if err != nil {
+		return r, ErrPassphrase
+	}
+	if err := wire.Unmarshal(plaintext, &r); err != nil {
+		return r, fmt.Errorf(`could not decode private request: %w`, err)
+	}
+	if r.ID != e.ID {
+		return r, ErrPassphrase
+	}
+	return r, nil
+}
@@ -0,0 +1,154 @@
+package data
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Unquabain/ephemeral/wire"
+)
+
+// FieldType tells the receiver how to present a Field.
+type FieldType string
+
+const (
+	// TextField is plain text that need not be hidden on screen.
+	TextField FieldType = `text`
+	// SecretField is text, such as a password, that should not be shown
+	// unless asked for.
+	SecretField FieldType = `secret`
+	// FileField is the content of a file, which may be binary.
+	FileField FieldType = `file`
+	// URLField is a link, such as the address of a service.
+	URLField FieldType = `url`
+)
+
+var fieldTypes = []FieldType{TextField, SecretField, FileField, URLField}
+
+// ParseFieldType reads the name of a field type. An empty name means
+// TextField.
+func ParseFieldType(name string) (FieldType, error) {
+	if name == `` {
+		return TextField, nil
+	}
+	for _, t := range fieldTypes {
+		if strings.EqualFold(name, string(t)) {
+			return t, nil
+		}
+	}
+	return ``, fmt.Errorf(`unknown field type %q: expected one of text, secret, file or url`, name)
+}
+
+// Field is one named part of a structured secret.
+type Field struct {
+	Name  string    `cbor:"1,keyasint"`
+	Type  FieldType `cbor:"2,keyasint"`
+	Value []byte    `cbor:"3,keyasint"`
+
+	// Filename is the name of the file a FileField was read from, if any.
+	Filename string `cbor:"4,keyasint,omitempty"`
+}
+
+// String returns the value of the field as text.
+func (f Field) String() string {
+	return string(f.Value)
+}
+
+// fieldJSON is how a Field is represented in JSON. Values that are not
+// valid UTF-8 are base64 encoded.
+type fieldJSON struct {
+	Name     string
+	Type     FieldType
+	Value    string
+	Encoding string `json:",omitempty"`
+	Filename string `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (f Field) MarshalJSON() ([]byte, error) {
+	j := fieldJSON{Name: f.Name, Type: f.Type, Filename: f.Filename}
+	if utf8.Valid(f.Value) {
+		j.Value = string(f.Value)
+	} else {
+		j.Value = base64.StdEncoding.EncodeToString(f.Value)
+		j.Encoding = `base64`
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (f *Field) UnmarshalJSON(b []byte) error {
+	var j fieldJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	t, err := ParseFieldType(string(j.Type))
+	if err != nil {
+		return err
+	}
+	*f = Field{Name: j.Name, Type: t, Filename: j.Filename}
+	switch j.Encoding {
+	case ``:
+		f.Value = []byte(j.Value)
+	case `base64`:
+		if f.Value, err = base64.StdEncoding.DecodeString(j.Value); err != nil {
+			return fmt.Errorf(`unable to decode field %q: %w`, j.Name, err)
+		}
+	default:
+		return fmt.Errorf(`unknown encoding %q for field %q`, j.Encoding, j.Name)
+	}
+	return nil
+}
+
+// Fields is a structured secret, such as a bundle of a host, a user name
+// and a password. It is encrypted in place of the raw data of a response,
+// which is marked with FieldsContent.
+type Fields []Field
+
+// fieldsMagic begins the plaintext of every structured secret, and names
+// the version of its encoding.
+const fieldsMagic = "\x00ephemeral fields v1\n"
+
+// MarshalBinary encodes the fields as the plaintext of a response.
+func (f Fields) MarshalBinary() ([]byte, error) {
+	names := make(map[string]bool)
+	for _, field := range f {
+		if field.Name == `` {
+			return nil, fmt.Errorf(`field has no name`)
+		} else if names[field.Name] {
+			return nil, fmt.Errorf(`field %q is given more than once`, field.Name)
+		}
+		names[field.Name] = true
+	}
+	b, err := wire.Marshal([]Field(f))
+	if err != nil {
+		return nil, fmt.Errorf(`unable to encode fields: %w`, err)
+	}
+	return append([]byte(fieldsMagic), b...), nil
+}
+
+// UnmarshalBinary decodes the fields from the plaintext of a response.
+func (f *Fields) UnmarshalBinary(plaintext []byte) error {
+	if !bytes.HasPrefix(plaintext, []byte(fieldsMagic)) {
+		return fmt.Errorf(`secret is not structured`)
+	}
+	var fields []Field
+	if err := wire.Unmarshal(plaintext[len(fieldsMagic):], &fields); err != nil {
+		return fmt.Errorf(`unable to decode fields: %w`, err)
+	}
+	*f = fields
+	return nil
+}
+
+// Get returns the field with the given name.
+func (f Fields) Get(name string) (Field, bool) {
+	for _, field := range f {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// fingerprintLabel separates fingerprints from any other hash of a request.
+const fingerprintLabel = `ephemeral fingerprint v1`
+
+// Fingerprint is a digest of a request's ID and public keys. If the
+// requester and the responder see the same fingerprint, the responder has
+// the public request the requester made, and not one swapped in by someone
+// else.
+type Fingerprint [sha256.Size]byte
+
+// Fingerprint returns the fingerprint of the request. The description and
+// signature are not included, so that the fingerprint identifies the keys
+// the response will be encrypted to, whatever the request claims.
+func (r PublicRequest) Fingerprint() (Fingerprint, error) {
+	buff := new(bytes.Buffer)
+	buff.WriteString(fingerprintLabel)
+	buff.Write(r.ID[:])
+	key, err := r.Key.MarshalBinary()
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf(`unable to marshal key for fingerprint: %w`, err)
+	}
+	writeField(buff, key)
+	if r.KEM != nil {
+		buff.WriteString(`ML-KEM-768`)
+		writeField(buff, r.KEM.Bytes())
+	}
+	return sha256.Sum256(buff.Bytes()), nil
+}
+
+// Fingerprint returns the fingerprint of the corresponding public request.
+func (r PrivateRequest) Fingerprint() (Fingerprint, error) {
+	return r.Public().Fingerprint()
+}
+
+// Prelude is the readable text above a request envelope: the description,
+// the verification code, so that the requester can read it out to the
+// responder, and when the request expires.
+func (r PrivateRequest) Prelude() (string, error) {
+	fingerprint, err := r.Fingerprint()
+	if err != nil {
+		return ``, err
+	}
+	lines := []string{
+		r.Description,
+		``,
+		`Verification code: ` + fingerprint.Code(),
+		`Fingerprint: ` + fingerprint.String(),
+	}
+	if !r.Expires.IsZero() {
+		lines = append(lines, `Expires `+r.Expires.Local().Format(time.RFC1123))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// String returns the whole fingerprint, in the style of SSH key
+// fingerprints.
+func (f Fingerprint) String() string {
+	return `SHA256:` + base64.RawStdEncoding.EncodeToString(f[:])
+}
+
+// codeDigits is the length of a short authentication code. Twelve digits
+// are about 40 bits, which is plenty for a comparison made within the
+// lifetime of one request.
+const codeDigits = 12
+
+// Code returns a short authentication string: a number that is easy to
+// read aloud and compare over the phone, such as "4821 0937 5512".
+func (f Fingerprint) Code() string {
+	n := binary.BigEndian.Uint64(f[:8]) % 1_000_000_000_000
+	digits := fmt.Sprintf(`%0*d`, codeDigits, n)
+	return digits[0:4] + ` ` + digits[4:8] + ` ` + digits[8:12]
+}
@@ -0,0 +1,134 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Encoder is implemented by anything a response can be made for: a single
+// PublicRequest or a GroupRequest.
+type Encoder interface {
+	Encode(data []byte) (Response, error)
+	EncodePadded(data []byte, padding Padding) (Response, error)
+	EncodeContent(data []byte, content Content, padding Padding) (Response, error)
+	EncodeStream(w io.Writer) (Response, io.WriteCloser, error)
+
+	// Requests lists the public requests whose holders will be able to
+	// decode the response.
+	Requests() []PublicRequest
+}
+
+// GroupRequest merges several public requests, so that one response can be
+// decoded by the private request of any member.
+type GroupRequest struct {
+	ID          uuid.UUID       `cbor:"1,keyasint"`
+	Description string          `cbor:"2,keyasint,omitempty"`
+	Members     []PublicRequest `cbor:"3,keyasint"`
+}
+
+// NewGroupRequest creates a group out of public requests. Members that are
+// listed more than once are only included once.
+func NewGroupRequest(description string, members ...PublicRequest) (GroupRequest, error) {
+	g := GroupRequest{
+		ID:          uuid.New(),
+		Description: description,
+	}
+	seen := make(map[uuid.UUID]bool)
+	for _, m := range members {
+		if seen[m.ID] {
+			continue
+		}
+		seen[m.ID] = true
+		g.Members = append(g.Members, m)
+	}
+	if len(g.Members) == 0 {
+		return g, fmt.Errorf(`a group request needs at least one member`)
+	}
+	return g, nil
+}
+
+// Requests returns the members of the group. It makes GroupRequest an Encoder.
+func (g GroupRequest) Requests() []PublicRequest {
+	return g.Members
+}
+
+// Encode encrypts the message once under a random content key, and then
+// encrypts that key for each member as an ordinary response. The message
+// is padded with DefaultPadding.
+func (g GroupRequest) Encode(data []byte) (Response, error) {
+	return g.EncodePadded(data, DefaultPadding)
+}
+
+// EncodePadded is like Encode, but pads the message with the given policy.
+// The content keys are all the same size, so they are never padded.
+func (g GroupRequest) EncodePadded(data []byte, padding Padding) (Response, error) {
+	return g.EncodeContent(data, RawContent, padding)
+}
+
+// EncodeContent is like EncodePadded, but marks the response as carrying
+// the given kind of content.
+func (g GroupRequest) EncodeContent(data []byte, content Content, padding Padding) (Response, error) {
+	response, cipher, err := g.prepare(HKDFGCM)
+	if err != nil {
+		return Response{}, err
+	}
+	if padding != NoPadding {
+		data = pad(data, padding)
+		response.Padded = true
+	}
+	response.Content = content
+	if response.Data, err = seal(data, response.additional(), cipher); err != nil {
+		return Response{}, fmt.Errorf(`unable to encrypt data: %w`, err)
+	}
+	return response, nil
+}
+
+// EncodeStream is like Encode, for payloads too large to hold in memory.
+// See PublicRequest.EncodeStream.
+func (g GroupRequest) EncodeStream(w io.Writer) (Response, io.WriteCloser, error) {
+	response, cipher, err := g.prepare(HKDFStream)
+	if err != nil {
+		return Response{}, nil, err
+	}
+	stream, err := newStreamWriter(w, cipher, response.additional())
+	if err != nil {
+		return Response{}, nil, err
+	}
+	return response, stream, nil
+}
+
+// prepare creates the content key, encrypts it for each member, and returns
+// the response header along with a cipher keyed with the content key.
+func (g GroupRequest) prepare(version ResponseVersion) (Response, cipher.Block, error) {
+	if len(g.Members) == 0 {
+		return Response{}, nil, fmt.Errorf(`group request has no members`)
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return Response{}, nil, fmt.Errorf(`unable to create content key: %w`, err)
+	}
+	cipher, err := aes.NewCipher(key)
+	if err != nil {
+		return Response{}, nil, fmt.Errorf(`unable to create cypher from content key: %w`, err)
+	}
+	response := Response{
+		ID:         g.ID,
+		Version:    version,
+		Commitment: commit(key),
+		Created:    time.Now().UTC().Truncate(time.Second),
+	}
+	for _, m := range g.Members {
+		if wrapped, err := m.EncodePadded(key, NoPadding); err != nil {
+			return Response{}, nil, fmt.Errorf(`unable to encrypt content key for %s: %w`, m.ID, err)
+		} else {
+			response.Recipients = append(response.Recipients, wrapped)
+		}
+	}
+	return response, cipher, nil
+}
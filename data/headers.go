@@ -0,0 +1,65 @@
+package data
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Unquabain/ephemeral/wire"
+	"github.com/google/uuid"
+)
+
+// headers returns the PEM-style envelope headers that everything with an ID
+// has. Headers describe the content for anyone sorting envelopes, but are
+// not authenticated: the content itself is always what counts.
+func headers(id uuid.UUID) map[string]string {
+	return map[string]string{
+		`Version`:    strconv.Itoa(wire.Version),
+		`Request-ID`: id.String(),
+	}
+}
+
+// Headers returns the envelope headers of the request: its curve, its
+// fingerprint and when it expires.
+func (r PublicRequest) Headers() map[string]string {
+	h := headers(r.ID)
+	h[`Curve`] = curveName(r.Key.Curve())
+	if r.KEM != nil {
+		h[`KEM`] = `ML-KEM-768`
+	}
+	if fingerprint, err := r.Fingerprint(); err == nil {
+		h[`Fingerprint`] = fingerprint.String()
+	}
+	if !r.Expires.IsZero() {
+		h[`Expires`] = r.Expires.UTC().Format(time.RFC3339)
+	}
+	return h
+}
+
+// Headers returns the envelope headers of the corresponding public request.
+func (r PrivateRequest) Headers() map[string]string {
+	return r.Public().Headers()
+}
+
+// Headers returns the envelope headers of the encrypted request. Its curve
+// cannot be known without the passphrase.
+func (e EncryptedPrivateRequest) Headers() map[string]string {
+	return headers(e.ID)
+}
+
+// Headers returns the envelope headers of the group, including how many
+// members it has.
+func (g GroupRequest) Headers() map[string]string {
+	h := headers(g.ID)
+	h[`Members`] = strconv.Itoa(len(g.Members))
+	return h
+}
+
+// Headers returns the envelope headers of the response. Request-ID is the
+// request that it answers.
+func (r Response) Headers() map[string]string {
+	h := headers(r.ID)
+	if !r.Created.IsZero() {
+		h[`Created`] = r.Created.UTC().Format(time.RFC3339)
+	}
+	return h
+}
@@ -0,0 +1,88 @@
+package data
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrBadSignature is returned when a signature does not match what it claims
+// to sign. The signed document has been altered, or the signature was copied
+// from somewhere else.
+var ErrBadSignature = errors.New(`signature does not match`)
+
+const signerKeyPrefix = `ed25519:`
+
+// Identity is a long-term Ed25519 signing key. Unlike request keys, it is kept
+// and reused, so that the people you trade secrets with can learn to
+// recognize it.
+type Identity struct {
+	Name string             `cbor:"1,keyasint,omitempty"`
+	Key  ed25519.PrivateKey `cbor:"2,keyasint"`
+}
+
+// NewIdentity creates a new identity with a random key.
+func NewIdentity(name string) (Identity, error) {
+	if _, k, err := ed25519.GenerateKey(rand.Reader); err != nil {
+		return Identity{}, fmt.Errorf(`unable to generate identity key: %w`, err)
+	} else {
+		return Identity{Name: name, Key: k}, nil
+	}
+}
+
+// Public returns the Signer that verifies this identity's signatures.
+func (id Identity) Public() Signer {
+	return Signer{
+		Name: id.Name,
+		Key:  id.Key.Public().(ed25519.PublicKey),
+	}
+}
+
+// Signer is the public half of an Identity. The Name is only what the owner
+// of the key chose to call themselves; the Key is what identifies them.
+type Signer struct {
+	Name string            `cbor:"1,keyasint,omitempty"`
+	Key  ed25519.PublicKey `cbor:"2,keyasint"`
+}
+
+// Verify checks a signature made by the corresponding Identity.
+func (s Signer) Verify(message, signature []byte) error {
+	if len(s.Key) != ed25519.PublicKeySize || !ed25519.Verify(s.Key, message, signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// KeyString is the text form of the key, as accepted by ParseSignerKey.
+func (s Signer) KeyString() string {
+	return signerKeyPrefix + base64.StdEncoding.EncodeToString(s.Key)
+}
+
+// String describes the signer for people to read.
+func (s Signer) String() string {
+	if s.Name == `` {
+		return s.KeyString()
+	}
+	return fmt.Sprintf(`%s (%s)`, s.Name, s.KeyString())
+}
+
+// Is reports whether both signers have the same key, regardless of name.
+func (s Signer) Is(other Signer) bool {
+	return s.Key.Equal(other.Key)
+}
+
+// ParseSignerKey reads the text form of a signer's key made by KeyString.
+func ParseSignerKey(text string) (Signer, error) {
+	text = strings.TrimPrefix(strings.TrimSpace(text), signerKeyPrefix)
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return Signer{}, fmt.Errorf(`could not decode signer key: %w`, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return Signer{}, fmt.Errorf(`signer key is %d bytes, not %d`, len(key), ed25519.PublicKeySize)
+	}
+	return Signer{Key: key}, nil
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"crypto/mlkem"
+	"fmt"
+)
+
+// KEMPrivateKey wraps an ML-KEM-768 decapsulation key. It is held alongside
+// the elliptic curve key of a hybrid request.
+type KEMPrivateKey struct{ *mlkem.DecapsulationKey768 }
+
+// NewKEMPrivateKey generates a new ML-KEM-768 decapsulation key.
+func NewKEMPrivateKey() (KEMPrivateKey, error) {
+	if k, err := mlkem.GenerateKey768(); err != nil {
+		return KEMPrivateKey{}, fmt.Errorf(`unable to generate ML-KEM key: %w`, err)
+	} else {
+		return KEMPrivateKey{k}, nil
+	}
+}
+
+// Public returns the encapsulation key that corresponds to this key.
+func (k KEMPrivateKey) Public() KEMPublicKey {
+	return KEMPublicKey{k.DecapsulationKey768.EncapsulationKey()}
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The key is stored as
+// its 64-byte seed.
+func (k KEMPrivateKey) MarshalBinary() ([]byte, error) {
+	return k.DecapsulationKey768.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (k *KEMPrivateKey) UnmarshalBinary(data []byte) error {
+	if dk, err := mlkem.NewDecapsulationKey768(data); err != nil {
+		return fmt.Errorf(`could not understand ML-KEM decapsulation key: %w`, err)
+	} else {
+		k.DecapsulationKey768 = dk
+	}
+	return nil
+}
+
+// Decapsulate recovers the shared secret from a ciphertext made with the
+// corresponding public key.
+func (k KEMPrivateKey) Decapsulate(ciphertext []byte) ([]byte, error) {
+	if secret, err := k.DecapsulationKey768.Decapsulate(ciphertext); err != nil {
+		return nil, fmt.Errorf(`could not decapsulate ML-KEM secret: %w`, err)
+	} else {
+		return secret, nil
+	}
+}
+
+// KEMPublicKey wraps an ML-KEM-768 encapsulation key.
+type KEMPublicKey struct{ *mlkem.EncapsulationKey768 }
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (k KEMPublicKey) MarshalBinary() ([]byte, error) {
+	return k.EncapsulationKey768.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (k *KEMPublicKey) UnmarshalBinary(data []byte) error {
+	if ek, err := mlkem.NewEncapsulationKey768(data); err != nil {
+		return fmt.Errorf(`could not understand ML-KEM encapsulation key: %w`, err)
+	} else {
+		k.EncapsulationKey768 = ek
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Padding is a policy for hiding the length of a secret. The plaintext is
+// padded up to the next size in a series of buckets before it is
+// encrypted, so that the response only shows which bucket it fell in.
+type Padding uint8
+
+const (
+	// NoPadding encrypts the plaintext as it is. The response shows its
+	// exact length.
+	NoPadding Padding = iota
+
+	// Padme pads to sizes whose binary representation has only as many
+	// significant bits as the length has bits in its own length. It never
+	// adds more than 12% and leaks O(log log n) bits of the length.
+	Padme
+
+	// PowerOfTwo pads to the next power of two. It hides more than Padme,
+	// but can nearly double the size of the response.
+	PowerOfTwo
+)
+
+// DefaultPadding is the policy Encode uses.
+const DefaultPadding = Padme
+
+// minPadded is the smallest bucket. Everything shorter, such as PINs and
+// most passwords, looks the same.
+const minPadded = 64
+
+var paddingNames = map[Padding]string{
+	NoPadding:  `none`,
+	Padme:      `padme`,
+	PowerOfTwo: `power2`,
+}
+
+func (p Padding) String() string {
+	if name, ok := paddingNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf(`Padding(%d)`, uint8(p))
+}
+
+// ParsePadding reads the name of a padding policy: none, padme or power2.
+// An empty name means DefaultPadding.
+func ParsePadding(name string) (Padding, error) {
+	if name == `` {
+		return DefaultPadding, nil
+	}
+	for p, n := range paddingNames {
+		if strings.EqualFold(name, n) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf(`unknown padding %q: expected none, padme or power2`, name)
+}
+
+// size returns the length that n bytes are padded to.
+func (p Padding) size(n int) int {
+	if n < minPadded {
+		return minPadded
+	}
+	switch p {
+	case Padme:
+		e := bits.Len(uint(n)) - 1
+		s := bits.Len(uint(e))
+		mask := 1<<(e-s) - 1
+		return (n + mask) &^ mask
+	case PowerOfTwo:
+		return 1 << bits.Len(uint(n-1))
+	default:
+		return n
+	}
+}
+
+// pad appends a 0x80 byte to data, followed by as many zeros as it takes to
+// reach the next bucket, as in ISO/IEC 7816-4.
+func pad(data []byte, p Padding) []byte {
+	size := p.size(len(data) + 1)
+	padded := make([]byte, size)
+	copy(padded, data)
+	padded[len(data)] = 0x80
+	return padded
+}
+
+// unpad reverses pad.
+func unpad(padded []byte) ([]byte, error) {
+	i := bytes.LastIndexByte(padded, 0x80)
+	if i < 0 || bytes.ContainsFunc(padded[i+1:], func(r rune) bool { return r != 0 }) {
+		return nil, fmt.Errorf(`padding is not valid: %w`, ErrCorrupt)
+	}
+	return padded[:i], nil
+}
@@ -52,14 +52,21 @@ func (pk PrivateKey) MarshalText() ([]byte, error) {
 // UnmarshalBinary implements encoding.BinaryUnmarshaler, and is used to
 // extract the PrivateKey from an envelope.
 func (pk *PrivateKey) UnmarshalBinary(data []byte) error {
-	if k, err := x509.ParsePKCS8PrivateKey(data); err != nil {
+	k, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
 		return fmt.Errorf(`could not understand PrivateKey as i509 PKCS8 Public Key: %w`, err)
-	} else if k, ok := k.(*ecdsa.PrivateKey); !ok {
-		return fmt.Errorf(`could not understand PrivateKey as i509 ECDSA Public Key: %w`, err)
-	} else if k, err := k.ECDH(); err != nil {
-		return fmt.Errorf(`could not understand PrivateKey as i509 ECDH Public Key: %w`, err)
-	} else {
+	}
+	switch k := k.(type) {
+	case *ecdh.PrivateKey:
 		pk.PrivateKey = k
+	case *ecdsa.PrivateKey:
+		if k, err := k.ECDH(); err != nil {
+			return fmt.Errorf(`could not understand PrivateKey as i509 ECDH Public Key: %w`, err)
+		} else {
+			pk.PrivateKey = k
+		}
+	default:
+		return fmt.Errorf(`could not understand PrivateKey of type %T as an ECDH Private Key`, k)
 	}
 	return nil
 }
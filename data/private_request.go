@@ -1,50 +1,281 @@
 package data
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // PrivateRequest contains the data necessary to make a full request.
 type PrivateRequest struct {
-	ID          uuid.UUID
-	Key         PrivateKey
-	Description string
+	ID          uuid.UUID  `cbor:"1,keyasint"`
+	Key         PrivateKey `cbor:"2,keyasint"`
+	Description string     `cbor:"3,keyasint,omitempty"`
+
+	// KEM is the ML-KEM decapsulation key of a hybrid request, or nil.
+	KEM *KEMPrivateKey `cbor:"4,keyasint,omitempty"`
+
+	// Expires is when the requester stops expecting a response. The zero
+	// value means never.
+	Expires time.Time `cbor:"5,keyasint,omitzero"`
+
+	// Age is set if the request was made to be an age recipient. Only such
+	// requests decode age files, which are not signed and do not expire.
+	Age bool `cbor:"6,keyasint,omitempty"`
+}
+
+// ExpireAfter sets the request to expire after the given duration from now.
+// A duration of zero means the request never expires.
+func (r *PrivateRequest) ExpireAfter(d time.Duration) {
+	if d == 0 {
+		r.Expires = time.Time{}
+		return
+	}
+	r.Expires = time.Now().UTC().Add(d).Truncate(time.Second)
+}
+
+// Late reports whether the response was made after the request expired.
+func (r PrivateRequest) Late(response Response) bool {
+	return r.Public().Late(response)
 }
 
 // Public returns the corresponding PublicRequest object, which
 // has the same data, except for it has the PublicKey that corresponds
 // to this PrivateRequest's PrivateKey.
 func (r PrivateRequest) Public() PublicRequest {
-	return PublicRequest{
+	public := PublicRequest{
 		ID:          r.ID,
 		Key:         r.Key.Public(),
 		Description: r.Description,
+		Expires:     r.Expires,
+	}
+	if r.KEM != nil {
+		kem := r.KEM.Public()
+		public.KEM = &kem
 	}
+	return public
+}
+
+// Hybrid reports whether the request combines ML-KEM with ECDH.
+func (r PrivateRequest) Hybrid() bool {
+	return r.KEM != nil
+}
+
+// MakeHybrid adds an ML-KEM-768 key to the request. Responses to it will
+// only be readable by someone who can break both ML-KEM and the elliptic
+// curve, which protects them against a future quantum computer.
+func (r *PrivateRequest) MakeHybrid() error {
+	if k, err := NewKEMPrivateKey(); err != nil {
+		return err
+	} else {
+		r.KEM = &k
+	}
+	return nil
+}
+
+// MismatchError is returned when a response is decoded with a private
+// request other than the one it was made for.
+type MismatchError struct {
+	// Response is the ID of the request the response was made for.
+	Response uuid.UUID
+	// Request is the ID of the private request it was decoded with.
+	Request uuid.UUID
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf(`this response was made for request %s, not %s`, e.Response, e.Request)
 }
 
 // Decode extracts the PublicKey from the response and decrypts the
-// response payload.
+// response payload. If the response was made for another request, the
+// returned error is a *MismatchError. If the response has been altered, the
+// returned error wraps ErrCorrupt. If the response is signed, the signature must match.
 func (r *PrivateRequest) Decode(response Response) ([]byte, error) {
-	cipher, err := cipherFromKeys(r.Key, response.Key)
+	plaintext, _, err := r.DecodeSigned(response)
+	return plaintext, err
+}
+
+// DecodeSigned is like Decode, but also returns the verified responder.
+// The signer is nil if the response is not signed. A response made for
+// another request is reported as such, whatever its signature.
+func (r *PrivateRequest) DecodeSigned(response Response) ([]byte, *Signer, error) {
+	if err := r.madeFor(response); err != nil {
+		return nil, nil, err
+	}
+	signer, err := response.Verify()
 	if err != nil {
-		return nil, fmt.Errorf(`unable to create cypher from secret: %w`, err)
+		return nil, nil, fmt.Errorf(`response signature is not valid: %w`, err)
+	}
+	plaintext, err := r.decode(response)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, signer, nil
+}
+
+// DecodeStream decrypts a streamed response. The header is the response
+// with no Data, and body is the stream of segments that followed it. The
+// signature, if any, is checked before anything is decrypted. If the body
+// has been altered or truncated, reading from the returned reader fails
+// with ErrCorrupt.
+func (r *PrivateRequest) DecodeStream(header Response, body io.Reader) (io.Reader, *Signer, error) {
+	if err := r.madeFor(header); err != nil {
+		return nil, nil, err
+	}
+	signer, err := header.Verify()
+	if err != nil {
+		return nil, nil, fmt.Errorf(`response signature is not valid: %w`, err)
+	}
+	if header.Version != HKDFStream {
+		return nil, nil, fmt.Errorf(`response version %d is not streamed`, header.Version)
+	}
+	block, err := r.payloadCipher(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := newStreamReader(body, block, header.additional())
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, signer, nil
+}
+
+// madeFor returns a *MismatchError unless the response was made for the
+// request, or for a group that the request belongs to.
+func (r *PrivateRequest) madeFor(response Response) error {
+	if response.ID == r.ID {
+		return nil
+	}
+	for _, recipient := range response.Recipients {
+		if recipient.ID == r.ID {
+			return nil
+		}
+	}
+	return &MismatchError{Response: response.ID, Request: r.ID}
+}
+
+func (r *PrivateRequest) decode(response Response) ([]byte, error) {
+	if response.Version == HKDFStream {
+		return nil, fmt.Errorf(`response is streamed, and must be decoded as a stream`)
+	}
+	block, err := r.payloadCipher(response)
+	if err != nil {
+		return nil, err
+	}
+	var plaintext []byte
+	switch response.Version {
+	case LegacyOFB:
+		plaintext, err = decryptOFB(response.Data, block)
+	default:
+		plaintext, err = open(response.Data, response.additional(), block)
 	}
-	plaintext, err := decrypt(response.Data, cipher)
 	if err != nil {
 		return nil, fmt.Errorf(`unable to decrypt data: %w`, err)
 	}
+	if response.Padded {
+		return unpad(plaintext)
+	}
 	return plaintext, nil
 }
 
+// payloadCipher returns the cipher that the payload of the response is
+// encrypted under. For a group response, this means finding this request
+// among the recipients, and decrypting the content key. If the response
+// was made for another request, the error is a MismatchError.
+func (r *PrivateRequest) payloadCipher(response Response) (cipher.Block, error) {
+	var (
+		key []byte
+		err error
+	)
+	switch {
+	case len(response.Recipients) > 0:
+		if key, err = r.contentKey(response); err != nil {
+			return nil, err
+		}
+	case response.ID != r.ID:
+		return nil, &MismatchError{Response: response.ID, Request: r.ID}
+	case response.Version == LegacyOFB || response.Version == AESGCM:
+		key, err = legacyKey(r.Key, response.Key)
+	case response.Version == HKDFGCM || response.Version == HKDFStream:
+		key, err = r.deriveKey(response)
+	default:
+		return nil, fmt.Errorf(`unsupported response version %d`, response.Version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf(`unable to create cypher from secret: %w`, err)
+	}
+	if err := checkCommitment(response.Version, key, response.Commitment); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf(`unable to create cypher from secret: %w`, err)
+	}
+	return block, nil
+}
+
+// contentKey finds this request among the recipients of a group response,
+// and decrypts the content key.
+func (r *PrivateRequest) contentKey(response Response) ([]byte, error) {
+	for _, recipient := range response.Recipients {
+		if recipient.ID != r.ID {
+			continue
+		}
+		key, err := r.decode(recipient)
+		if err != nil {
+			return nil, fmt.Errorf(`unable to decrypt content key: %w`, err)
+		}
+		return key, nil
+	}
+	return nil, &MismatchError{Response: response.ID, Request: r.ID}
+}
+
+func (r *PrivateRequest) deriveKey(response Response) ([]byte, error) {
+	secret, err := r.Key.Secret(response.Key)
+	if err != nil {
+		return nil, fmt.Errorf(`unable to create shared secret: %w`, err)
+	}
+	ctx := keyContext{
+		ID:        r.ID,
+		Requester: r.Key.Public(),
+		Responder: response.Key,
+		Expires:   r.Expires,
+	}
+	switch {
+	case r.KEM != nil && len(response.KEMCiphertext) == 0:
+		return nil, fmt.Errorf(`request is hybrid, but the response has no ML-KEM ciphertext`)
+	case r.KEM == nil && len(response.KEMCiphertext) > 0:
+		return nil, fmt.Errorf(`response is hybrid, but the request has no ML-KEM key`)
+	case r.KEM != nil:
+		kemSecret, err := r.KEM.Decapsulate(response.KEMCiphertext)
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, kemSecret...)
+		kem := r.KEM.Public()
+		ctx.RequesterKEM = &kem
+		ctx.KEMCiphertext = response.KEMCiphertext
+	}
+	return deriveKey(secret, ctx)
+}
+
 // NewRequest creates a new request with a random private key.
 func NewRequest(description string) (PrivateRequest, error) {
+	return NewCurveRequest(description, RandomCurve())
+}
+
+// NewCurveRequest creates a new request with a private key on the given curve.
+func NewCurveRequest(description string, curve ecdh.Curve) (PrivateRequest, error) {
 	var (
 		r PrivateRequest
 	)
 	r.ID = uuid.New()
-	if k, err := NewPrivateKey(RandomCurve()); err != nil {
+	if k, err := NewPrivateKey(curve); err != nil {
 		return r, fmt.Errorf(`unable to find appropriate curve: %w`, err)
 	} else {
 		r.Key = k
@@ -12,8 +12,12 @@ import (
 type PublicKey struct{ *ecdh.PublicKey }
 
 // MarshalBinary implements encoding.BinaryMarshaler, and is used to insert
-// the PublicKey in an envelope.
+// the PublicKey in an envelope. A missing key, as in a group response, is
+// empty.
 func (pk PublicKey) MarshalBinary() ([]byte, error) {
+	if pk.PublicKey == nil {
+		return nil, nil
+	}
 	if pk, err := x509.MarshalPKIXPublicKey(pk.PublicKey); err != nil {
 		return nil, fmt.Errorf(`could not create PKIX encoding of key: %w`, err)
 	} else {
@@ -35,14 +39,25 @@ func (pk PublicKey) MarshalText() ([]byte, error) {
 // UnmarshalBinary implements encoding.BinaryUnmarshaler, and is used to extract
 // the PublicKey from an envelope.
 func (pk *PublicKey) UnmarshalBinary(data []byte) error {
-	if k, err := x509.ParsePKIXPublicKey(data); err != nil {
+	if len(data) == 0 {
+		pk.PublicKey = nil
+		return nil
+	}
+	k, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
 		return fmt.Errorf(`could not understand PublicKey as i509 PKIX Public Key: %w`, err)
-	} else if k, ok := k.(*ecdsa.PublicKey); !ok {
-		return fmt.Errorf(`could not understand PublicKey as i509 ECDSA Public Key: %w`, err)
-	} else if k, err := k.ECDH(); err != nil {
-		return fmt.Errorf(`could not understand PublicKey as i509 ECDH Public Key: %w`, err)
-	} else {
+	}
+	switch k := k.(type) {
+	case *ecdh.PublicKey:
 		pk.PublicKey = k
+	case *ecdsa.PublicKey:
+		if k, err := k.ECDH(); err != nil {
+			return fmt.Errorf(`could not understand PublicKey as i509 ECDH Public Key: %w`, err)
+		} else {
+			pk.PublicKey = k
+		}
+	default:
+		return fmt.Errorf(`could not understand PublicKey of type %T as an ECDH Public Key`, k)
 	}
 	return nil
 }
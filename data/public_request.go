@@ -1,7 +1,14 @@
 package data
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -9,30 +16,188 @@ import (
 // PublicRequest contains the information to be packed in an envelope for the
 // public part of the request, which may travel over public channels such as Slack.
 type PublicRequest struct {
-	ID          uuid.UUID
-	Key         PublicKey
-	Description string
+	ID          uuid.UUID `cbor:"1,keyasint"`
+	Key         PublicKey `cbor:"2,keyasint"`
+	Description string    `cbor:"3,keyasint,omitempty"`
+
+	// KEM is the ML-KEM encapsulation key of a hybrid request, or nil.
+	KEM *KEMPublicKey `cbor:"4,keyasint,omitempty"`
+
+	// Signer and Signature are set if the requester signed the request with
+	// their identity.
+	Signer    *Signer `cbor:"5,keyasint,omitempty"`
+	Signature []byte  `cbor:"6,keyasint,omitempty"`
+
+	// Expires is when the requester stops expecting a response. The zero
+	// value means never.
+	Expires time.Time `cbor:"7,keyasint,omitzero"`
+}
+
+// Expired reports whether the request expires, and has done so by now.
+func (r PublicRequest) Expired(now time.Time) bool {
+	return !r.Expires.IsZero() && now.After(r.Expires)
+}
+
+// Late reports whether the response was made after the request expired.
+func (r PublicRequest) Late(response Response) bool {
+	return r.Expired(response.Created)
+}
+
+// publicRequestLabel separates request signatures from any other use of an
+// identity key.
+const publicRequestLabel = `ephemeral public request v1`
+
+// signedBytes serializes everything the requester's signature covers.
+func (r PublicRequest) signedBytes() ([]byte, error) {
+	buff := new(bytes.Buffer)
+	buff.WriteString(publicRequestLabel)
+	buff.Write(r.ID[:])
+	key, err := r.Key.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf(`unable to marshal key for signature: %w`, err)
+	}
+	writeLongField(buff, key)
+	writeLongField(buff, []byte(r.Description))
+	if r.KEM != nil {
+		writeLongField(buff, r.KEM.Bytes())
+	} else {
+		writeLongField(buff, nil)
+	}
+	if r.Signer != nil {
+		writeLongField(buff, []byte(r.Signer.Name))
+		writeLongField(buff, r.Signer.Key)
+	}
+	if !r.Expires.IsZero() {
+		binary.Write(buff, binary.BigEndian, r.Expires.Unix())
+	}
+	return buff.Bytes(), nil
+}
+
+// Sign signs the request with the requester's identity, so that a responder
+// can tell who made it.
+func (r *PublicRequest) Sign(id Identity) error {
+	signer := id.Public()
+	r.Signer = &signer
+	message, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	r.Signature = ed25519.Sign(id.Key, message)
+	return nil
+}
+
+// Verify checks the requester's signature, and returns who made it. If the
+// request is not signed, both return values are nil. If the signature does
+// not match, the error is ErrBadSignature.
+func (r PublicRequest) Verify() (*Signer, error) {
+	if r.Signer == nil && len(r.Signature) == 0 {
+		return nil, nil
+	}
+	if r.Signer == nil {
+		return nil, ErrBadSignature
+	}
+	message, err := r.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Signer.Verify(message, r.Signature); err != nil {
+		return nil, err
+	}
+	return r.Signer, nil
+}
+
+// Requests returns the request itself. It makes PublicRequest an Encoder.
+func (r PublicRequest) Requests() []PublicRequest {
+	return []PublicRequest{r}
 }
 
 // Encode creates a complementary key, encrypts the message, and returns
 // a response object that can be decrypted with the corresponding private key
-// that generated the public request.
+// that generated the public request. If the request is hybrid, a second
+// secret is encapsulated to its ML-KEM key and combined with the first.
+// The message is padded with DefaultPadding.
 func (r PublicRequest) Encode(data []byte) (Response, error) {
+	return r.EncodePadded(data, DefaultPadding)
+}
+
+// EncodePadded is like Encode, but pads the message with the given policy.
+func (r PublicRequest) EncodePadded(data []byte, padding Padding) (Response, error) {
+	return r.EncodeContent(data, RawContent, padding)
+}
+
+// EncodeContent is like EncodePadded, but marks the response as carrying
+// the given kind of content.
+func (r PublicRequest) EncodeContent(data []byte, content Content, padding Padding) (Response, error) {
+	response, cipher, err := r.prepare(HKDFGCM)
+	if err != nil {
+		return Response{}, err
+	}
+	if padding != NoPadding {
+		data = pad(data, padding)
+		response.Padded = true
+	}
+	response.Content = content
+	if response.Data, err = seal(data, response.additional(), cipher); err != nil {
+		return Response{}, fmt.Errorf(`unable to encrypt data: %w`, err)
+	}
+	return response, nil
+}
+
+// EncodeStream is like Encode, for payloads too large to hold in memory.
+// Streams are not padded, since their segments show their length anyway. It
+// returns the response header, which has no Data, and a writer that
+// encrypts everything written to it into w. The header must be written out
+// before anything is written to the writer, and the writer must be closed
+// to finish the stream.
+func (r PublicRequest) EncodeStream(w io.Writer) (Response, io.WriteCloser, error) {
+	response, cipher, err := r.prepare(HKDFStream)
+	if err != nil {
+		return Response{}, nil, err
+	}
+	stream, err := newStreamWriter(w, cipher, response.additional())
+	if err != nil {
+		return Response{}, nil, err
+	}
+	return response, stream, nil
+}
+
+// prepare creates the response header, and the cipher its payload will be
+// encrypted under.
+func (r PublicRequest) prepare(version ResponseVersion) (Response, cipher.Block, error) {
 	privateKey, err := NewPrivateKey(r.Key.Curve())
 	if err != nil {
-		return Response{}, fmt.Errorf(`unable to create private key: %w`, err)
+		return Response{}, nil, fmt.Errorf(`unable to create private key: %w`, err)
+	}
+	secret, err := privateKey.Secret(r.Key)
+	if err != nil {
+		return Response{}, nil, fmt.Errorf(`unable to create shared secret: %w`, err)
 	}
-	cipher, err := cipherFromKeys(privateKey, r.Key)
+	ctx := keyContext{
+		ID:        r.ID,
+		Requester: r.Key,
+		Responder: privateKey.Public(),
+		Expires:   r.Expires,
+	}
+	if r.KEM != nil {
+		kemSecret, ciphertext := r.KEM.Encapsulate()
+		secret = append(secret, kemSecret...)
+		ctx.RequesterKEM = r.KEM
+		ctx.KEMCiphertext = ciphertext
+	}
+	key, err := deriveKey(secret, ctx)
 	if err != nil {
-		return Response{}, fmt.Errorf(`unable to create cypher from secret: %w`, err)
+		return Response{}, nil, err
 	}
-	ciphertext, err := encrypt(data, cipher)
+	cipher, err := aes.NewCipher(key)
 	if err != nil {
-		return Response{}, fmt.Errorf(`unable to encrypt data: %w`, err)
+		return Response{}, nil, fmt.Errorf(`unable to create cypher from secret: %w`, err)
 	}
 	return Response{
-		ID:   r.ID,
-		Data: ciphertext,
-		Key:  privateKey.Public(),
-	}, nil
+		ID:            r.ID,
+		Key:           privateKey.Public(),
+		Version:       version,
+		KEMCiphertext: ctx.KEMCiphertext,
+		Commitment:    commit(key),
+		Created:       time.Now().UTC().Truncate(time.Second),
+	}, cipher, nil
 }
@@ -1,10 +1,189 @@
 package data
 
-import "github.com/google/uuid"
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ResponseVersion identifies the scheme used to encrypt a Response.
+type ResponseVersion uint8
+
+const (
+	// LegacyOFB responses were encrypted with unauthenticated AES-OFB. They
+	// can still be decoded, but tampering cannot be detected.
+	LegacyOFB ResponseVersion = iota
+
+	// AESGCM responses are encrypted and authenticated with AES-256-GCM, but
+	// their key is folded directly out of the shared secret.
+	AESGCM
+
+	// HKDFGCM responses are encrypted with AES-256-GCM under a key derived
+	// with HKDF-SHA256 from the shared secret, the request ID and both public
+	// keys.
+	HKDFGCM
+
+	// HKDFStream responses use the same key as HKDFGCM, but have no Data.
+	// Instead, the payload follows the response header as a stream of
+	// AES-256-GCM segments, so that it never has to be held in memory.
+	HKDFStream
+)
+
+// CurrentVersion is the version used for new responses.
+const CurrentVersion = HKDFGCM
+
+// Content says what the plaintext of a response is, so that the receiver
+// does not have to guess from the plaintext itself.
+type Content uint8
+
+const (
+	// RawContent is a secret that is written out as it is.
+	RawContent Content = iota
+
+	// FieldsContent is a structured secret: the MarshalBinary of Fields.
+	FieldsContent
+
+	// ShareContent is one share of a split secret: the MarshalBinary of a
+	// Share.
+	ShareContent
+)
 
 // Response represents encrypted data that can be shared over public channels.
 type Response struct {
-	ID   uuid.UUID
-	Key  PublicKey
-	Data []byte
+	ID      uuid.UUID       `cbor:"1,keyasint"`
+	Key     PublicKey       `cbor:"2,keyasint,omitempty"`
+	Data    []byte          `cbor:"3,keyasint,omitempty"`
+	Version ResponseVersion `cbor:"4,keyasint,omitempty"`
+
+	// KEMCiphertext is the ML-KEM encapsulation of the second shared secret.
+	// It is only present in responses to hybrid requests.
+	KEMCiphertext []byte `cbor:"5,keyasint,omitempty"`
+
+	// Recipients is only present in responses to a GroupRequest. Each is the
+	// content key that Data is encrypted under, encrypted for one member.
+	Recipients []Response `cbor:"6,keyasint,omitempty"`
+
+	// Signer and Signature are set if the responder signed the response with
+	// their identity.
+	Signer    *Signer `cbor:"7,keyasint,omitempty"`
+	Signature []byte  `cbor:"8,keyasint,omitempty"`
+
+	// Created is when the response was made, according to the responder.
+	Created time.Time `cbor:"9,keyasint,omitzero"`
+
+	// Commitment identifies the key that Data is encrypted under, so that
+	// it can only be decrypted under that one key. Responses made before key
+	// commitment do not have it.
+	Commitment []byte `cbor:"10,keyasint,omitempty"`
+
+	// Padded is set if the plaintext was padded to hide its length before
+	// it was encrypted.
+	Padded bool `cbor:"11,keyasint,omitempty"`
+
+	// Content says what the plaintext is. It is authenticated along with
+	// the payload, so it cannot be changed without the receiver noticing.
+	Content Content `cbor:"12,keyasint,omitempty"`
+}
+
+// additional returns the data that is authenticated, but not encrypted,
+// along with the payload.
+func (r Response) additional() []byte {
+	ad := r.ID[:]
+	if !r.Created.IsZero() {
+		ad = binary.BigEndian.AppendUint64(ad, uint64(r.Created.Unix()))
+	}
+	if r.Padded {
+		ad = append(ad, 'p')
+	}
+	if r.Content != RawContent {
+		ad = append(ad, 'c', byte(r.Content))
+	}
+	return ad
+}
+
+// responseLabel separates response signatures from any other use of an
+// identity key.
+const responseLabel = `ephemeral response v1`
+
+// signedBytes serializes everything the responder's signature covers.
+func (r Response) signedBytes() ([]byte, error) {
+	buff := new(bytes.Buffer)
+	buff.WriteString(responseLabel)
+	buff.Write(r.ID[:])
+	buff.WriteByte(byte(r.Version))
+	if r.Key.PublicKey != nil {
+		key, err := r.Key.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf(`unable to marshal key for signature: %w`, err)
+		}
+		writeLongField(buff, key)
+	} else {
+		writeLongField(buff, nil)
+	}
+	writeLongField(buff, r.Data)
+	writeLongField(buff, r.KEMCiphertext)
+	binary.Write(buff, binary.BigEndian, uint32(len(r.Recipients)))
+	for _, recipient := range r.Recipients {
+		b, err := recipient.signedBytes()
+		if err != nil {
+			return nil, err
+		}
+		writeLongField(buff, b)
+	}
+	if r.Signer != nil {
+		writeLongField(buff, []byte(r.Signer.Name))
+		writeLongField(buff, r.Signer.Key)
+	}
+	if !r.Created.IsZero() {
+		binary.Write(buff, binary.BigEndian, r.Created.Unix())
+	}
+	if len(r.Commitment) > 0 {
+		buff.WriteString(`commitment`)
+		writeLongField(buff, r.Commitment)
+	}
+	if r.Padded {
+		buff.WriteString(`padded`)
+	}
+	if r.Content != RawContent {
+		buff.WriteString(`content`)
+		buff.WriteByte(byte(r.Content))
+	}
+	return buff.Bytes(), nil
+}
+
+// Sign signs the response with the responder's identity, so that the
+// requester can tell who sent it.
+func (r *Response) Sign(id Identity) error {
+	signer := id.Public()
+	r.Signer = &signer
+	message, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	r.Signature = ed25519.Sign(id.Key, message)
+	return nil
+}
+
+// Verify checks the responder's signature, and returns who made it. If the
+// response is not signed, both return values are nil. If the signature does
+// not match, the error is ErrBadSignature.
+func (r Response) Verify() (*Signer, error) {
+	if r.Signer == nil && len(r.Signature) == 0 {
+		return nil, nil
+	}
+	if r.Signer == nil {
+		return nil, ErrBadSignature
+	}
+	message, err := r.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Signer.Verify(message, r.Signature); err != nil {
+		return nil, err
+	}
+	return r.Signer, nil
 }
@@ -0,0 +1,272 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Unquabain/ephemeral/wire"
+	"github.com/google/uuid"
+)
+
+// Share is one part of a secret split with Shamir's scheme. Any Threshold
+// shares of the same split rebuild the secret, and fewer reveal nothing
+// about it.
+type Share struct {
+	// Split identifies the secret the share belongs to, so that shares of
+	// different secrets are not combined.
+	Split     uuid.UUID `cbor:"1,keyasint"`
+	Threshold int       `cbor:"2,keyasint"`
+	Total     int       `cbor:"3,keyasint"`
+
+	// Index is where the share's polynomials were evaluated, from 1 to
+	// Total.
+	Index int    `cbor:"4,keyasint"`
+	Value []byte `cbor:"5,keyasint"`
+
+	// Checksum covers everything else in the share, so that a damaged
+	// share is caught before it is combined.
+	Checksum []byte `cbor:"6,keyasint"`
+
+	// Content says what the secret is, as it does in a Response.
+	Content Content `cbor:"7,keyasint,omitempty"`
+}
+
+// ErrMixedShares is returned when shares of different secrets are combined.
+var ErrMixedShares = errors.New(`shares belong to different secrets`)
+
+// ErrTooFewShares is returned when fewer shares are combined than are needed
+// to rebuild the secret.
+var ErrTooFewShares = errors.New(`too few shares to rebuild the secret`)
+
+// shareLabel separates share checksums from any other hash.
+const shareLabel = `ephemeral share v1`
+
+// splitTagLabel separates the tag that is split along with the secret from
+// any other hash.
+const splitTagLabel = `ephemeral split secret v1`
+
+// splitTagSize is the length of the tag. It is split along with the
+// secret, so fewer than Threshold shares reveal nothing about it either.
+const splitTagSize = 16
+
+// Split divides the secret into total shares, any threshold of which can
+// rebuild it.
+func Split(secret []byte, total, threshold int) ([]Share, error) {
+	return SplitContent(secret, RawContent, total, threshold)
+}
+
+// SplitContent is like Split, but marks the shares as carrying the given
+// kind of content.
+func SplitContent(secret []byte, content Content, total, threshold int) ([]Share, error) {
+	if threshold < 2 || threshold > total || total > 255 {
+		return nil, fmt.Errorf(`cannot split a secret %d ways with a threshold of %d: need 2 <= threshold <= shares <= 255`, total, threshold)
+	}
+	id := uuid.New()
+	tagged := append(bytes.Clone(secret), splitTag(id, content, secret)...)
+	shares := make([]Share, total)
+	for i := range shares {
+		shares[i] = Share{
+			Split:     id,
+			Threshold: threshold,
+			Total:     total,
+			Index:     i + 1,
+			Value:     make([]byte, len(tagged)),
+			Content:   content,
+		}
+	}
+	coefficients := make([]byte, threshold)
+	for j, b := range tagged {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, fmt.Errorf(`unable to create polynomial: %w`, err)
+		}
+		for i := range shares {
+			shares[i].Value[j] = evaluate(coefficients, byte(shares[i].Index))
+		}
+	}
+	for i := range shares {
+		shares[i].Checksum = shares[i].checksum()
+	}
+	return shares, nil
+}
+
+// Combine rebuilds a secret from its shares. Every share given is used, so
+// one that does not belong is detected even if there are enough without
+// it. Shares that claim a threshold Split could not have made are refused,
+// since a single share with a threshold of 1 would be taken as the secret.
+// What the secret is, is given by the Content of the shares, which must
+// all be the same.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf(`no shares given: %w`, ErrTooFewShares)
+	}
+	first := shares[0]
+	if first.Threshold < 2 || first.Threshold > first.Total || first.Total > 255 {
+		return nil, fmt.Errorf(`shares of %s claim %d of %d are needed, but need 2 <= threshold <= shares <= 255: %w`, first.Split, first.Threshold, first.Total, ErrCorrupt)
+	}
+	byIndex := make(map[int]Share)
+	for _, s := range shares {
+		if err := s.Check(); err != nil {
+			return nil, err
+		}
+		if s.Split != first.Split || s.Threshold != first.Threshold || s.Total != first.Total || s.Content != first.Content {
+			return nil, fmt.Errorf(`share %d of %s and share %d of %s: %w`, first.Index, first.Split, s.Index, s.Split, ErrMixedShares)
+		}
+		if other, ok := byIndex[s.Index]; ok && !bytes.Equal(other.Value, s.Value) {
+			return nil, fmt.Errorf(`share %d is given twice, with different values: %w`, s.Index, ErrCorrupt)
+		}
+		byIndex[s.Index] = s
+	}
+	if len(byIndex) < first.Threshold {
+		return nil, fmt.Errorf(`%d shares are needed to rebuild the secret, but only %d were given: %w`, first.Threshold, len(byIndex), ErrTooFewShares)
+	}
+	var (
+		xs     []byte
+		values [][]byte
+	)
+	for index, s := range byIndex {
+		if len(s.Value) != len(first.Value) {
+			return nil, fmt.Errorf(`share %d is the wrong length: %w`, index, ErrCorrupt)
+		}
+		xs = append(xs, byte(index))
+		values = append(values, s.Value)
+	}
+	tagged := make([]byte, len(first.Value))
+	ys := make([]byte, len(xs))
+	for j := range tagged {
+		for i := range values {
+			ys[i] = values[i][j]
+		}
+		tagged[j] = interpolate(xs, ys)
+	}
+	if len(tagged) < splitTagSize {
+		return nil, fmt.Errorf(`shares are too short: %w`, ErrCorrupt)
+	}
+	secret, tag := tagged[:len(tagged)-splitTagSize], tagged[len(tagged)-splitTagSize:]
+	if subtle.ConstantTimeCompare(tag, splitTag(first.Split, first.Content, secret)) != 1 {
+		return nil, fmt.Errorf(`rebuilt secret does not match its tag: %w`, ErrCorrupt)
+	}
+	return secret, nil
+}
+
+// Prelude says which share an envelope holds, and how many are needed.
+func (s Share) Prelude() string {
+	return fmt.Sprintf("Share %d of %d of secret %s\n%d shares are needed to rebuild it.", s.Index, s.Total, s.Split, s.Threshold)
+}
+
+// Check verifies the share's checksum.
+func (s Share) Check() error {
+	if s.Index < 1 || s.Index > s.Total || s.Total > 255 || subtle.ConstantTimeCompare(s.Checksum, s.checksum()) != 1 {
+		return fmt.Errorf(`share %d of %s is damaged: %w`, s.Index, s.Split, ErrCorrupt)
+	}
+	return nil
+}
+
+func (s Share) checksum() []byte {
+	h := sha256.New()
+	h.Write([]byte(shareLabel))
+	h.Write(s.Split[:])
+	var header [12]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(s.Threshold))
+	binary.BigEndian.PutUint32(header[4:], uint32(s.Total))
+	binary.BigEndian.PutUint32(header[8:], uint32(s.Index))
+	h.Write(header[:])
+	h.Write([]byte{byte(s.Content)})
+	h.Write(s.Value)
+	return h.Sum(nil)
+}
+
+func splitTag(id uuid.UUID, content Content, secret []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(splitTagLabel))
+	h.Write(id[:])
+	h.Write([]byte{byte(content)})
+	h.Write(secret)
+	return h.Sum(nil)[:splitTagSize]
+}
+
+// shareMagic begins the plaintext of every response that carries a share,
+// which is marked with ShareContent, and names the version of its encoding.
+const shareMagic = "\x00ephemeral share v1\n"
+
+// shareFields has the fields of a Share, but not its methods, so that the
+// encoder does not call MarshalBinary on it again.
+type shareFields Share
+
+// MarshalBinary encodes the share as the plaintext of a response.
+func (s Share) MarshalBinary() ([]byte, error) {
+	b, err := wire.Marshal(shareFields(s))
+	if err != nil {
+		return nil, fmt.Errorf(`unable to encode share: %w`, err)
+	}
+	return append([]byte(shareMagic), b...), nil
+}
+
+// UnmarshalBinary decodes the share from the plaintext of a response, and
+// checks it.
+func (s *Share) UnmarshalBinary(plaintext []byte) error {
+	if !bytes.HasPrefix(plaintext, []byte(shareMagic)) {
+		return fmt.Errorf(`secret is not a share`)
+	}
+	var share shareFields
+	if err := wire.Unmarshal(plaintext[len(shareMagic):], &share); err != nil {
+		return fmt.Errorf(`unable to decode share: %w`, err)
+	}
+	if err := Share(share).Check(); err != nil {
+		return err
+	}
+	*s = Share(share)
+	return nil
+}
+
+// evaluate returns the value of the polynomial at x in GF(2^8).
+func evaluate(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coefficients[i]
+	}
+	return y
+}
+
+// interpolate returns the value at 0 of the polynomial through the points.
+func interpolate(xs, ys []byte) byte {
+	var y byte
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i != j {
+				// In GF(2^8), 0 - xj = xj and xi - xj = xi ^ xj.
+				basis = gfMul(basis, gfMul(xs[j], gfInv(xs[i]^xs[j])))
+			}
+		}
+		y ^= gfMul(ys[i], basis)
+	}
+	return y
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without branching
+// on its arguments.
+func gfMul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse, a^254, in GF(2^8).
+func gfInv(a byte) byte {
+	r := byte(1)
+	for range 7 {
+		a = gfMul(a, a)
+		r = gfMul(r, a)
+	}
+	return r
+}
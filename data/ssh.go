@@ -0,0 +1,140 @@
+package data
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+
+	"filippo.io/edwards25519"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshNamespace is the namespace of the IDs of requests made from SSH keys.
+// The ID is derived from the key, so that the holder of the private key
+// can work it out without ever having seen a request.
+var sshNamespace = uuid.MustParse(`67f9e93e-a139-4a60-8ebf-e16ca2535ac0`)
+
+func sshRequestID(key ssh.PublicKey) uuid.UUID {
+	return uuid.NewSHA1(sshNamespace, key.Marshal())
+}
+
+// SSHRequest makes a public request out of an ssh-ed25519 or ECDSA public
+// key, so that a response can be made for the key's owner without a
+// request round trip. Ed25519 keys are converted to X25519, as age does.
+// The description is the key's comment, or else its fingerprint.
+func SSHRequest(key ssh.PublicKey, comment string) (PublicRequest, error) {
+	var public *ecdh.PublicKey
+	crypto, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return PublicRequest{}, fmt.Errorf(`unsupported SSH key type %s`, key.Type())
+	}
+	switch k := crypto.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		point, err := new(edwards25519.Point).SetBytes(k)
+		if err != nil {
+			return PublicRequest{}, fmt.Errorf(`invalid ssh-ed25519 key: %w`, err)
+		}
+		if public, err = ecdh.X25519().NewPublicKey(point.BytesMontgomery()); err != nil {
+			return PublicRequest{}, fmt.Errorf(`unable to convert ssh-ed25519 key: %w`, err)
+		}
+	case *ecdsa.PublicKey:
+		var err error
+		if public, err = k.ECDH(); err != nil {
+			return PublicRequest{}, fmt.Errorf(`unable to convert ECDSA key: %w`, err)
+		}
+	default:
+		return PublicRequest{}, fmt.Errorf(`unsupported SSH key type %s: only ssh-ed25519 and ECDSA keys can be recipients`, key.Type())
+	}
+	if comment == `` {
+		comment = ssh.FingerprintSHA256(key)
+	}
+	return PublicRequest{
+		ID:          sshRequestID(key),
+		Key:         PublicKey{public},
+		Description: comment,
+	}, nil
+}
+
+// ParseSSHRecipients reads public keys in authorized_keys format, such as a
+// user's authorized_keys file or their keys from GitHub. Keys that cannot
+// be recipients, such as RSA keys, are skipped and listed.
+func ParseSSHRecipients(in []byte) ([]PublicRequest, []string, error) {
+	var (
+		requests []PublicRequest
+		skipped  []string
+	)
+	for len(in) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(in)
+		if err != nil {
+			break
+		}
+		in = rest
+		if request, err := SSHRequest(key, comment); err != nil {
+			skipped = append(skipped, fmt.Sprintf(`%s %s`, key.Type(), ssh.FingerprintSHA256(key)))
+		} else {
+			requests = append(requests, request)
+		}
+	}
+	if len(requests) == 0 {
+		return nil, skipped, fmt.Errorf(`no ssh-ed25519 or ECDSA public keys found`)
+	}
+	return requests, skipped, nil
+}
+
+// SSHPrivateRequest makes a private request out of an OpenSSH private key,
+// which decodes responses made for the SSHRequest of its public key. If the
+// key is encrypted, passphrase is called to ask for its passphrase.
+func SSHPrivateRequest(pemBytes []byte, passphrase func() ([]byte, error)) (PrivateRequest, error) {
+	raw, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		pass, perr := passphrase()
+		if perr != nil {
+			return PrivateRequest{}, perr
+		}
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, pass)
+	}
+	if err != nil {
+		return PrivateRequest{}, fmt.Errorf(`unable to read SSH private key: %w`, err)
+	}
+	var (
+		private *ecdh.PrivateKey
+		public  ssh.PublicKey
+	)
+	switch k := raw.(type) {
+	case *ed25519.PrivateKey:
+		private, public, err = ed25519Request(*k)
+	case ed25519.PrivateKey:
+		private, public, err = ed25519Request(k)
+	case *ecdsa.PrivateKey:
+		if private, err = k.ECDH(); err == nil {
+			public, err = ssh.NewPublicKey(&k.PublicKey)
+		}
+	default:
+		return PrivateRequest{}, fmt.Errorf(`unsupported SSH key type %T: only ssh-ed25519 and ECDSA keys can decode responses`, raw)
+	}
+	if err != nil {
+		return PrivateRequest{}, fmt.Errorf(`unable to convert SSH private key: %w`, err)
+	}
+	return PrivateRequest{
+		ID:          sshRequestID(public),
+		Key:         PrivateKey{private},
+		Description: ssh.FingerprintSHA256(public),
+	}, nil
+}
+
+// ed25519Request converts an Ed25519 private key to the X25519 key that
+// matches the conversion of its public key in SSHRequest.
+func ed25519Request(k ed25519.PrivateKey) (*ecdh.PrivateKey, ssh.PublicKey, error) {
+	h := sha512.Sum512(k.Seed())
+	private, err := ecdh.X25519().NewPrivateKey(h[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := ssh.NewPublicKey(k.Public())
+	return private, public, err
+}
@@ -0,0 +1,153 @@
+package data
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// segmentSize is the amount of plaintext in each segment of a stream.
+const segmentSize = 64 * 1024
+
+// The STREAM construction splits the payload into segments, and seals each
+// with AES-GCM under a nonce made of the segment's position and a flag
+// marking the last segment. Segments cannot be reordered, dropped or
+// truncated without detection. Because every stream is encrypted under a
+// fresh key, the nonce does not need a random part.
+func segmentNonce(aead cipher.AEAD, counter uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[aead.NonceSize()-9:], counter)
+	if last {
+		nonce[aead.NonceSize()-1] = 1
+	}
+	return nonce
+}
+
+type streamWriter struct {
+	w          io.Writer
+	aead       cipher.AEAD
+	additional []byte
+	buff       []byte
+	counter    uint64
+	closed     bool
+}
+
+// newStreamWriter returns a writer that encrypts everything written to it
+// into w. It writes nothing to w until the first segment is full or it is
+// closed. It must be closed to write the last segment.
+func newStreamWriter(w io.Writer, block cipher.Block, additional []byte) (io.WriteCloser, error) {
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf(`could not create GCM cipher: %w`, err)
+	}
+	return &streamWriter{
+		w:          w,
+		aead:       aead,
+		additional: additional,
+		buff:       make([]byte, 0, segmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamWriter) flush(last bool) error {
+	nonce := segmentNonce(s.aead, s.counter, last)
+	s.counter++
+	if _, err := s.w.Write(s.aead.Seal(s.buff[:0], nonce, s.buff, s.additional)); err != nil {
+		return fmt.Errorf(`could not write segment: %w`, err)
+	}
+	s.buff = s.buff[:0]
+	return nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New(`write to closed stream`)
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full segment is only written once more data arrives, so that
+		// the last segment is never mistaken for a middle one.
+		if len(s.buff) == segmentSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(s.buff[len(s.buff):segmentSize], p)
+		s.buff = s.buff[:len(s.buff)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close writes the last segment. It does not close the underlying writer.
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+type streamReader struct {
+	r          *bufio.Reader
+	aead       cipher.AEAD
+	additional []byte
+	buff       []byte
+	plaintext  []byte
+	counter    uint64
+	err        error
+}
+
+// newStreamReader returns a reader that decrypts a stream made by
+// newStreamWriter. If the stream has been altered or truncated, Read
+// returns ErrCorrupt.
+func newStreamReader(r io.Reader, block cipher.Block, additional []byte) (io.Reader, error) {
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf(`could not create GCM cipher: %w`, err)
+	}
+	return &streamReader{
+		r:          bufio.NewReader(r),
+		aead:       aead,
+		additional: additional,
+		buff:       make([]byte, segmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamReader) next() error {
+	n, err := io.ReadFull(s.r, s.buff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf(`could not read segment: %w`, err)
+	}
+	// Only the last segment is followed by the end of the stream.
+	if _, err = s.r.Peek(1); err != nil && err != io.EOF {
+		return fmt.Errorf(`could not read segment: %w`, err)
+	}
+	last := err == io.EOF
+	nonce := segmentNonce(s.aead, s.counter, last)
+	s.counter++
+	plaintext, err := s.aead.Open(s.buff[:0], nonce, s.buff[:n], s.additional)
+	if err != nil {
+		return ErrCorrupt
+	}
+	s.plaintext = plaintext
+	if last {
+		return io.EOF
+	}
+	return nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plaintext) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.err = s.next()
+	}
+	n := copy(p, s.plaintext)
+	s.plaintext = s.plaintext[n:]
+	return n, nil
+}
@@ -0,0 +1,123 @@
+package envelope
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bech32Charset is the alphabet of Bech32, as specified in BIP 173.
+const bech32Charset = `qpzry9x8gf2tvdw0s3jn54khce6mua7l`
+
+var bech32Generator = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i, g := range bech32Generator {
+			if (top>>i)&1 == 1 {
+				chk ^= g
+			}
+		}
+	}
+	return chk
+}
+
+func bech32ExpandHRP(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+// convertBits regroups a string of from-bit values into to-bit values.
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var (
+		acc    uint32
+		bits   uint
+		result []byte
+		maxv   = uint32(1)<<to - 1
+	)
+	for _, b := range data {
+		if uint32(b)>>from != 0 {
+			return nil, fmt.Errorf(`invalid data range: %d`, b)
+		}
+		acc = acc<<from | uint32(b)
+		bits += from
+		for bits >= to {
+			bits -= to
+			result = append(result, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			result = append(result, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, fmt.Errorf(`invalid padding`)
+	}
+	return result, nil
+}
+
+// Bech32Encode encodes data as Bech32 with the given human-readable part.
+// Unlike BIP 173, it does not limit the length, since keys can be long.
+func Bech32Encode(hrp string, data []byte) (string, error) {
+	values, err := convertBits(data, 8, 5, true)
+	if err != nil {
+		return ``, err
+	}
+	hrp = strings.ToLower(hrp)
+	check := append(bech32ExpandHRP(hrp), values...)
+	polymod := bech32Polymod(append(check, 0, 0, 0, 0, 0, 0)) ^ 1
+	for i := range 6 {
+		values = append(values, byte(polymod>>(5*(5-i))&31))
+	}
+	var out strings.Builder
+	out.WriteString(hrp)
+	out.WriteByte('1')
+	for _, v := range values {
+		out.WriteByte(bech32Charset[v])
+	}
+	return out.String(), nil
+}
+
+// Bech32Decode decodes a Bech32 string, and returns its human-readable part
+// in lower case along with its data.
+func Bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return ``, nil, fmt.Errorf(`bech32 string is mixed case`)
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return ``, nil, fmt.Errorf(`bech32 string has no separator, or is too short`)
+	}
+	hrp := s[:sep]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return ``, nil, fmt.Errorf(`bech32 prefix has an invalid character`)
+		}
+	}
+	values := make([]byte, 0, len(s)-sep-1)
+	for i := sep + 1; i < len(s); i++ {
+		v := strings.IndexByte(bech32Charset, s[i])
+		if v < 0 {
+			return ``, nil, fmt.Errorf(`bech32 string has an invalid character %q at %d`, s[i], i)
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(append(bech32ExpandHRP(hrp), values...)) != 1 {
+		return ``, nil, fmt.Errorf(`bech32 checksum does not match: %w`, ErrDamaged)
+	}
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return ``, nil, fmt.Errorf(`bech32 data is not valid: %w`, err)
+	}
+	return hrp, data, nil
+}
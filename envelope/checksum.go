@@ -0,0 +1,167 @@
+package envelope
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrDamaged is returned when the text of an envelope does not match its
+// checksum, which means it was changed on its way from the sender: a
+// character was lost or swapped by a chat client, or a line was dropped.
+var ErrDamaged = errors.New(`envelope was damaged in transit`)
+
+// crc24 continues the CRC-24 of OpenPGP's ASCII armor (RFC 4880, section
+// 6.1) over data.
+func crc24(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for range 8 {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crc24Poly
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+const (
+	crc24Init = 0xb704ce
+	crc24Poly = 0x1864cfb
+
+	// base64Alphabet is the alphabet of the data lines, and of the checksum.
+	base64Alphabet = `ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/`
+)
+
+// lineCheck is the check character of one line of data: six bits of the
+// CRC-24 of its text. It finds which line was damaged, which the checksum
+// of the whole data cannot.
+func lineCheck(line []byte) byte {
+	return base64Alphabet[crc24(crc24Init, line)&63]
+}
+
+// writeChecksum writes the checksum lines that follow the data. The first
+// begins, as in OpenPGP, with = and the base64 of the CRC-24 of the data.
+// The check character of each line of data follows, wrapped onto more lines
+// that begin with = if need be.
+func writeChecksum(w io.Writer, crc uint32, checks []byte) error {
+	sum := base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)})
+	text := append([]byte(sum), checks...)
+	for len(text) > 0 {
+		n := min(wrapLength, len(text))
+		if _, err := fmt.Fprintf(w, "=%s\n", text[:n]); err != nil {
+			return fmt.Errorf(`could not write checksum: %w`, err)
+		}
+		text = text[n:]
+	}
+	return nil
+}
+
+// checksum collects what is needed to check the data of an envelope as its
+// lines are read.
+type checksum struct {
+	crc     uint32
+	checks  []byte
+	numbers []int
+	trailer []string
+
+	// quoted is set if the checksum lines were quoted-printable.
+	quoted bool
+}
+
+func newChecksum() *checksum {
+	return &checksum{crc: crc24Init}
+}
+
+// Write adds decoded data to the CRC-24.
+func (c *checksum) Write(p []byte) (int, error) {
+	c.crc = crc24(c.crc, p)
+	return len(p), nil
+}
+
+// line checks a line of data, which is line number of the text, and notes
+// its check character.
+func (c *checksum) line(number int, line []byte) error {
+	for _, b := range line {
+		if b != '=' && strings.IndexByte(base64Alphabet, b) < 0 {
+			return fmt.Errorf(`%w: line %d has a character that cannot be in an envelope: %q`, ErrDamaged, number, b)
+		}
+	}
+	c.checks = append(c.checks, lineCheck(line))
+	c.numbers = append(c.numbers, number)
+	return nil
+}
+
+// verify compares the data with the checksum lines. Envelopes made before
+// there were checksums have none, and are not checked. If the data could
+// not be decoded, its CRC-24 is meaningless, and only the lines are
+// compared; if none of them is to blame, verify leaves the caller to report
+// its own error.
+//
+// A mail program that encodes the envelope as quoted-printable writes the
+// = that begins each checksum line as =3D. A checksum line can also begin
+// with =3D by chance, so when every line begins with 3D, the checksum is
+// checked as it is, and then without them.
+func (c *checksum) verify(decoded bool) error {
+	trailer := strings.Join(c.trailer, ``)
+	if trailer == `` {
+		return nil
+	}
+	err := c.verifyTrailer(trailer, decoded)
+	if err == nil {
+		return nil
+	}
+	unquoted := make([]string, len(c.trailer))
+	for i, line := range c.trailer {
+		var ok bool
+		if unquoted[i], ok = strings.CutPrefix(line, `3D`); !ok {
+			return err
+		}
+	}
+	if c.verifyTrailer(strings.Join(unquoted, ``), decoded) != nil {
+		return err
+	}
+	c.quoted = true
+	return nil
+}
+
+// verifyTrailer compares the data with the text of the checksum lines.
+func (c *checksum) verifyTrailer(trailer string, decoded bool) error {
+	var sum []byte
+	if len(trailer) >= 4 {
+		sum, _ = base64.StdEncoding.DecodeString(trailer[:4])
+	}
+	if len(sum) != 3 {
+		return fmt.Errorf(`%w: the checksum line is not readable`, ErrDamaged)
+	}
+	if decoded && uint32(sum[0])<<16|uint32(sum[1])<<8|uint32(sum[2]) == c.crc {
+		return nil
+	}
+	checks := trailer[4:]
+	switch {
+	case checks == `` && decoded:
+		return fmt.Errorf(`%w: the data does not match its checksum`, ErrDamaged)
+	case checks == ``:
+		return nil
+	case len(checks) != len(c.checks):
+		return fmt.Errorf(`%w: the data has %d lines, but the checksum is for %d, so a line was added or lost`, ErrDamaged, len(c.checks), len(checks))
+	}
+	var damaged []string
+	for i := range checks {
+		if checks[i] != c.checks[i] {
+			damaged = append(damaged, fmt.Sprint(c.numbers[i]))
+		}
+	}
+	switch {
+	case len(damaged) == 0 && decoded:
+		return fmt.Errorf(`%w: the data does not match its checksum, but no one line is to blame`, ErrDamaged)
+	case len(damaged) == 0:
+		return nil
+	case len(damaged) == 1:
+		return fmt.Errorf(`%w: line %s does not match its checksum`, ErrDamaged, damaged[0])
+	}
+	return fmt.Errorf(`%w: lines %s do not match their checksums`, ErrDamaged, strings.Join(damaged, `, `))
+}
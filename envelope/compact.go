@@ -0,0 +1,171 @@
+package envelope
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// compactNames are the short names that compact envelopes are written
+// with, after the eph prefix. Only these envelopes have compact forms. They
+// are also read with their whole name in lower case, with hyphens for
+// spaces, after eph-, such as eph-public-request1....
+var compactNames = map[string]string{
+	`PUBLIC REQUEST`:            `pub`,
+	`PRIVATE REQUEST`:           `priv`,
+	`ENCRYPTED PRIVATE REQUEST`: `encpriv`,
+	`GROUP REQUEST`:             `group`,
+	`RESPONSE`:                  `resp`,
+	`STREAMED RESPONSE`:         `stream`,
+	`SHARE`:                     `share`,
+	`IDENTITY`:                  `id`,
+	`PUBLIC IDENTITY`:           `pubid`,
+}
+
+// compactPattern finds compact envelopes in text: the eph prefix and a
+// name, followed by 1 and Bech32, or by : and base64url.
+var compactPattern = regexp.MustCompile(`(?i)\beph(?:-[a-z][a-z-]*|[a-z]*)(?:1[02-9ac-hj-np-z]{6,}|:[A-Za-z0-9_-]{4,})`)
+
+// compactPrefix returns the human-readable prefix of a compact envelope, or
+// an error if the envelope has no compact form.
+func compactPrefix(name string) (string, error) {
+	if short, ok := compactNames[strings.ToUpper(name)]; ok {
+		return `eph` + short, nil
+	}
+	return ``, fmt.Errorf(`%s envelopes have no compact form`, name)
+}
+
+// compactName returns the name of the envelope that a prefix stands for, or
+// false if it is not the prefix of a compact envelope.
+func compactName(prefix string) (string, bool) {
+	prefix = strings.ToLower(prefix)
+	if name, ok := strings.CutPrefix(prefix, `eph-`); ok {
+		name = strings.ToUpper(strings.ReplaceAll(name, `-`, ` `))
+		_, known := compactNames[name]
+		return name, known
+	}
+	short, ok := strings.CutPrefix(prefix, `eph`)
+	if !ok {
+		return ``, false
+	}
+	for name, s := range compactNames {
+		if s == short {
+			return name, true
+		}
+	}
+	return ``, false
+}
+
+// compress returns the data as it is compressed in an armored envelope.
+func compress(data []byte) ([]byte, error) {
+	buff := new(bytes.Buffer)
+	zip, _ := zlib.NewWriterLevel(buff, zlib.BestCompression)
+	if _, err := zip.Write(data); err != nil {
+		return nil, fmt.Errorf(`could not compress data: %w`, err)
+	}
+	if err := zip.Close(); err != nil {
+		return nil, fmt.Errorf(`could not finalize compressed data: %w`, err)
+	}
+	return buff.Bytes(), nil
+}
+
+// Bech32 returns the envelope as a single line of Bech32, such as
+// ephpub1..., for places where an armored envelope is awkward: text
+// messages, ticket titles and URLs. Only the name and the data are kept;
+// the prelude, headers and postlude are left out. The Bech32 checksum takes
+// the place of the envelope's own.
+func (e Envelope) Bech32() (string, error) {
+	prefix, err := compactPrefix(e.Name)
+	if err != nil {
+		return ``, err
+	}
+	zipped, err := compress(e.Data)
+	if err != nil {
+		return ``, err
+	}
+	return Bech32Encode(prefix, zipped)
+}
+
+// Base64URL returns the envelope as a single line of URL-safe base64, such
+// as ephpub:..., which is shorter than Bech32, but must be copied with its
+// case intact. As with Bech32, only the name and the data are kept. The
+// CRC-24 of the compressed data follows it, as in an armored envelope.
+func (e Envelope) Base64URL() (string, error) {
+	prefix, err := compactPrefix(e.Name)
+	if err != nil {
+		return ``, err
+	}
+	zipped, err := compress(e.Data)
+	if err != nil {
+		return ``, err
+	}
+	crc := crc24(crc24Init, zipped)
+	zipped = append(zipped, byte(crc>>16), byte(crc>>8), byte(crc))
+	return prefix + `:` + base64.RawURLEncoding.EncodeToString(zipped), nil
+}
+
+// expandCompact decodes a compact envelope, and returns it armored, so that
+// it can be read like any other. The checksum lines are made from the
+// compressed data, which has already been checked.
+func expandCompact(compact string) ([]string, error) {
+	var (
+		name   string
+		zipped []byte
+		ok     bool
+	)
+	if prefix, encoded, found := strings.Cut(compact, `:`); found {
+		if name, ok = compactName(prefix); !ok {
+			return nil, fmt.Errorf(`%q is not a compact envelope`, prefix)
+		}
+		b, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil || len(b) < 3 {
+			return nil, fmt.Errorf(`%w: the compact %s is not readable`, ErrDamaged, name)
+		}
+		zipped = b[:len(b)-3]
+		if crc24(crc24Init, zipped) != uint32(b[len(b)-3])<<16|uint32(b[len(b)-2])<<8|uint32(b[len(b)-1]) {
+			return nil, fmt.Errorf(`%w: the compact %s does not match its checksum`, ErrDamaged, name)
+		}
+	} else {
+		prefix, b, err := Bech32Decode(compact)
+		if err != nil {
+			return nil, err
+		}
+		if name, ok = compactName(prefix); !ok {
+			return nil, fmt.Errorf(`%q is not a compact envelope`, prefix)
+		}
+		zipped = b
+	}
+
+	armored := new(strings.Builder)
+	lines := &lineWriter{w: armored, check: true}
+	b64 := base64.NewEncoder(base64.StdEncoding, lines)
+	b64.Write(zipped)
+	b64.Close()
+	lines.end()
+	writeChecksum(armored, crc24(crc24Init, zipped), lines.checks)
+
+	expanded := []string{fmt.Sprintf(`----- BEGIN %s -----`, name)}
+	expanded = append(expanded, strings.Split(strings.TrimSuffix(armored.String(), "\n"), "\n")...)
+	return append(expanded, fmt.Sprintf(`----- END %s -----`, name)), nil
+}
+
+// findCompact returns the locations of the text in line that looks like
+// compact envelopes, with prefixes that name them.
+func findCompact(line string) [][]int {
+	var found [][]int
+	for _, loc := range compactPattern.FindAllStringIndex(line, -1) {
+		prefix := line[loc[0]:loc[1]]
+		if i := strings.IndexByte(prefix, ':'); i >= 0 {
+			prefix = prefix[:i]
+		} else {
+			prefix = prefix[:strings.LastIndexByte(prefix, '1')]
+		}
+		if _, ok := compactName(prefix); ok {
+			found = append(found, loc)
+		}
+	}
+	return found
+}
@@ -3,139 +3,152 @@ package envelope
 import (
 	"bytes"
 	"compress/zlib"
-	"encoding/base64"
-	"encoding/gob"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+
+	"github.com/Unquabain/ephemeral/wire"
 )
 
 // Envelope is an ASCII-armored format for passing keys and encrypted data over
-// the wire. It looks a bit like PEM, but uses Go's internal gob format.
+// the wire. It looks a bit like PEM. Its content is in the format of the wire
+// package, or in Go's gob format if it was made by an older version.
 type Envelope struct {
-	Name     string
-	Prelude  string
+	Name    string
+	Prelude string
+
+	// Headers are PEM-style "Key: Value" lines between the BEGIN line and
+	// the data. They let tools sort envelopes without opening them, but
+	// they are not authenticated, so nothing should be trusted because a
+	// header says so.
+	Headers map[string]string
+
 	Data     []byte
 	Postlude string
-}
 
-const wrapLength = 64
-
-type wrapper struct {
-	io.WriteCloser
-	ll int
+	// Repairs lists what UnmarshalText had to repair to read the envelope,
+	// for the user to be told about. It is not written by MarshalText.
+	Repairs []string
 }
 
-func zip(data []byte) ([]byte, error) {
-	in := bytes.NewReader(data)
-	out := new(bytes.Buffer)
-	if w, err := zlib.NewWriterLevel(out, zlib.BestCompression); err != nil {
-		return nil, fmt.Errorf(`could not create compression writer: %w`, err)
-	} else if _, err := io.Copy(w, in); err != nil {
-		return nil, fmt.Errorf(`could not compress data: %w`, err)
-	} else if err := w.Close(); err != nil {
-		return nil, fmt.Errorf(`could not finalize compressed data: %w`, err)
-	}
-	return out.Bytes(), nil
-}
+const wrapLength = 64
 
-func unzip(data []byte) ([]byte, error) {
-	in := bytes.NewReader(data)
-	out := new(bytes.Buffer)
-	if reader, err := zlib.NewReader(in); err != nil {
-		return nil, fmt.Errorf(`could not create new zlib reader: %w`, err)
-	} else if _, err := io.Copy(out, reader); err != nil {
-		return nil, fmt.Errorf(`could not decompress data: %w`, err)
+// writeHeaders writes the headers in a stable order, with Version first,
+// followed by the blank line that ends them.
+func writeHeaders(w io.Writer, headers map[string]string) error {
+	if len(headers) == 0 {
+		return nil
 	}
-	return out.Bytes(), nil
-}
-
-func encode(data []byte) ([]byte, error) {
-	in := bytes.NewReader(data)
-	out := new(bytes.Buffer)
-	enc := base64.NewEncoder(base64.StdEncoding, out)
-	if _, err := io.Copy(enc, in); err != nil {
-		return nil, fmt.Errorf(`could not encode data: %w`, err)
+	keys := make([]string, 0, len(headers))
+	for key, value := range headers {
+		if key == `` || strings.ContainsAny(key, ": \t\r\n") {
+			return fmt.Errorf(`invalid header name %q`, key)
+		}
+		if strings.ContainsAny(value, "\r\n") || strings.Contains(value, `-----`) {
+			return fmt.Errorf(`invalid value for header %s: %q`, key, value)
+		}
+		keys = append(keys, key)
 	}
-	if err := enc.Close(); err != nil {
-		return nil, fmt.Errorf(`could not finalize encoding: %w`, err)
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == `Version`) != (keys[j] == `Version`) {
+			return keys[i] == `Version`
+		}
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "%s: %s\n", key, headers[key]); err != nil {
+			return err
+		}
 	}
-	return out.Bytes(), nil
+	_, err := io.WriteString(w, "\n")
+	return err
 }
 
-func decode(data []byte) ([]byte, error) {
-	in := bytes.NewReader(data)
-	out := new(bytes.Buffer)
-	if _, err := io.Copy(out, base64.NewDecoder(base64.StdEncoding, in)); err != nil {
-		return nil, fmt.Errorf(`could not decode data: %w`, err)
-	}
-	return out.Bytes(), nil
+// headerParser reads PEM-style headers a line at a time. A line that
+// begins with white space continues the header above it.
+type headerParser struct {
+	headers map[string]string
+	last    string
 }
 
-func wrap(data []byte) ([]byte, error) {
-	out := new(bytes.Buffer)
-	for len(data) >= wrapLength {
-		if _, err := out.Write(data[:wrapLength]); err != nil {
-			return nil, fmt.Errorf(`could not wrap data: %w`, err)
-		}
-		if _, err := out.WriteRune('\n'); err != nil {
-			return nil, fmt.Errorf(`could not wrap data: %w`, err)
-		}
-		data = data[wrapLength:]
+// parse reads one line, and reports whether it belonged to the headers.
+// The first line that does not is the start of the data.
+func (h *headerParser) parse(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == `` {
+		h.last = ``
+		return true
 	}
-	if len(data) > 0 {
-		if _, err := out.Write(data); err != nil {
-			return nil, fmt.Errorf(`could not wrap data: %w`, err)
-		}
-		if _, err := out.WriteRune('\n'); err != nil {
-			return nil, fmt.Errorf(`could not wrap data: %w`, err)
-		}
+	if h.last != `` && (line[0] == ' ' || line[0] == '\t') {
+		h.headers[h.last] += ` ` + trimmed
+		return true
 	}
-
-	return out.Bytes(), nil
+	key, value, ok := strings.Cut(trimmed, `:`)
+	if !ok {
+		return false
+	}
+	if h.headers == nil {
+		h.headers = make(map[string]string)
+	}
+	h.last = strings.TrimSpace(key)
+	h.headers[h.last] = strings.TrimSpace(value)
+	return true
 }
 
 // MarshalText implements encoding.TextMarshaler, and performs the
 // binary-to-text conversion of the envelope.
 func (e Envelope) MarshalText() ([]byte, error) {
 	buff := new(bytes.Buffer)
-	fmt.Fprintln(buff, e.Prelude)
-	fmt.Fprintf(buff, "----- BEGIN %s -----\n", strings.ToUpper(e.Name))
+	if _, err := e.WriteTo(buff); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
 
-	if data, err := zip(e.Data); err != nil {
-		return nil, fmt.Errorf(`could not zip data: %w`, err)
-	} else if data, err := encode(data); err != nil {
-		return nil, fmt.Errorf(`could not encode data: %w`, err)
-	} else if data, err := wrap(data); err != nil {
-		return nil, fmt.Errorf(`could not wrap data: %w`, err)
-	} else if _, err := buff.Write(data); err != nil {
-		return nil, fmt.Errorf(`could not write data: %w`, err)
+// WriteTo writes the envelope as text to w, compressing, encoding and
+// wrapping the data as it goes. Unlike an Encoder, it writes the check
+// character of each line, which it can afford to hold.
+func (e Envelope) WriteTo(w io.Writer) (int64, error) {
+	counted := &countingWriter{w: w}
+	enc := newEncoder(counted, e.Name, e.Prelude, zlib.BestCompression, true)
+	enc.Headers = e.Headers
+	enc.Postlude = e.Postlude
+	if _, err := enc.Write(e.Data); err != nil {
+		return counted.n, fmt.Errorf(`could not write data: %w`, err)
+	}
+	if err := enc.Close(); err != nil {
+		return counted.n, err
 	}
+	return counted.n, nil
+}
 
-	fmt.Fprintf(buff, "----- END %s -----\n", strings.ToUpper(e.Name))
-	fmt.Fprintln(buff, e.Postlude)
-	return buff.Bytes(), nil
+// countingWriter counts what is written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
 // UnmarshalText implements encoding.TextUnmarshaler, and performs the text-to-binary
-// conversion of the envelope.
+// conversion of the envelope. It reads the first envelope in the text, which
+// is repaired as a Decoder repairs it. If the data does not match its
+// checksum, the error wraps ErrDamaged and names the damaged lines.
 func (e *Envelope) UnmarshalText(data []byte) error {
-	parts := strings.Split(string(data), `-----`)
-	if l := len(parts); l != 5 {
-		return fmt.Errorf(`not enough dash-delimited parts: expected 5, found %d`, l)
+	dec, err := NewDecoder(bytes.NewReader(data))
+	if err != nil {
+		return err
 	}
-	e.Prelude = strings.TrimSpace(parts[0])
-	e.Name = strings.TrimSpace(strings.TrimPrefix(parts[1], ` BEGIN `))
-
-	if data, err := decode([]byte(parts[2])); err != nil {
-		return fmt.Errorf(`unable to decode data: %w`, err)
-	} else if data, err := unzip(data); err != nil {
-		return fmt.Errorf(`unable to unzip data: %w`, err)
-	} else {
-		e.Data = data
+	env, err := dec.Envelope()
+	if err != nil {
+		return err
 	}
-
-	e.Postlude = strings.TrimSpace(parts[4])
+	*e = env
 	return nil
 }
 
@@ -145,7 +158,9 @@ func (e errorReader) Read(_ []byte) (int, error) {
 	return 0, e.error
 }
 
-// Reader returns an io.Reader to facilitate writing the Envelope to data streams.
+// Reader returns an io.Reader to facilitate writing the Envelope to data
+// streams. The text is made all at once; use WriteTo to write it as it is
+// made.
 func (e Envelope) Reader() io.Reader {
 	if data, err := e.MarshalText(); err != nil {
 		return errorReader{err}
@@ -154,14 +169,36 @@ func (e Envelope) Reader() io.Reader {
 	}
 }
 
-// ReadFrom reads data from an io.Reader to faciltate reading from data streams.
+// ReadFrom reads data from an io.Reader to faciltate reading from data
+// streams. The text is decoded as it is read, and only the data is held.
+// The rest of the input, after the first envelope, is read and ignored.
 func (e *Envelope) ReadFrom(r io.Reader) (int64, error) {
-	buff := new(bytes.Buffer)
-	n, err := io.Copy(buff, r)
+	counted := &countingReader{r: r}
+	dec, err := NewDecoder(counted)
+	if err != nil {
+		return counted.n, err
+	}
+	env, err := dec.Envelope()
 	if err != nil {
-		return int64(n), err
+		return counted.n, err
+	}
+	if _, err := io.Copy(io.Discard, counted); err != nil {
+		return counted.n, err
 	}
-	return int64(n), e.UnmarshalText(buff.Bytes())
+	*e = env
+	return counted.n, nil
+}
+
+// countingReader counts what is read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 // DataReader returns an io.Reader that reads just the binary data field of the Envelope.
@@ -185,12 +222,17 @@ func (e *Envelope) DataWriter() io.Writer {
 
 // Stuff serializes the content and puts it in the Data member.
 func (e *Envelope) Stuff(content any) error {
-	return gob.NewEncoder(e.DataWriter()).Encode(content)
+	b, err := wire.Marshal(content)
+	if err != nil {
+		return err
+	}
+	_, err = e.DataWriter().Write(b)
+	return err
 }
 
 // Open deserializes the data in the Data member, putting it into target, which must be
 // a pointer to a compatible type. It is for the caller to use the informational fields
 // of the Envelope to determine the correct type for the target member.
 func (e *Envelope) Open(target any) error {
-	return gob.NewDecoder(e.DataReader()).Decode(target)
+	return wire.Unmarshal(e.Data, target)
 }
@@ -2,7 +2,10 @@ package envelope_test
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"mime/quotedprintable"
+	"strings"
 	"testing"
 
 	"github.com/Unquabain/ephemeral/envelope"
@@ -85,3 +88,448 @@ func TestEnvelopeDataReaderWriter(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(data, writer.Bytes())
 }
+
+func TestEncoderDecoder(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * i)
+	}
+	buff := new(bytes.Buffer)
+	enc := envelope.NewEncoder(buff, `test envelope`, `A prelude`)
+	enc.Headers = map[string]string{`Version`: `1`}
+	enc.Postlude = `A postlude`
+	assert.NoError(envelope.WriteContent(enc, `header`))
+	_, err := enc.Write(data)
+	assert.NoError(err)
+	assert.NoError(enc.Close())
+
+	// The streamed envelope can be read whole.
+	var whole envelope.Envelope
+	assert.NoError(whole.UnmarshalText(buff.Bytes()), buff.String())
+	assert.Equal(`TEST ENVELOPE`, whole.Name)
+	assert.Equal(`A prelude`, whole.Prelude)
+	assert.Equal(`A postlude`, whole.Postlude)
+	assert.Equal(`1`, whole.Headers[`Version`])
+
+	dec, err := envelope.NewDecoder(bytes.NewReader(buff.Bytes()))
+	assert.NoError(err)
+	assert.Equal(`TEST ENVELOPE`, dec.Name)
+	assert.Equal(`A prelude`, dec.Prelude)
+	var header string
+	assert.NoError(envelope.ReadContent(dec, &header))
+	assert.Equal(`header`, header)
+	recovered, err := io.ReadAll(dec)
+	assert.NoError(err)
+	assert.Equal(data, recovered)
+
+	// An envelope written whole can be streamed.
+	text, err := envelope.Envelope{Name: `TEST ENVELOPE`, Data: data}.MarshalText()
+	assert.NoError(err)
+	dec, err = envelope.NewDecoder(bytes.NewReader(text))
+	assert.NoError(err)
+	recovered, err = io.ReadAll(dec)
+	assert.NoError(err)
+	assert.Equal(data, recovered)
+
+	// Reader and ReadFrom stream the text as well.
+	var streamed envelope.Envelope
+	n, err := streamed.ReadFrom(envelope.Envelope{Name: `TEST ENVELOPE`, Data: data}.Reader())
+	assert.NoError(err)
+	assert.Equal(int64(len(text)), n)
+	assert.Equal(data, streamed.Data)
+}
+
+func TestHeaders(t *testing.T) {
+	assert := assert.New(t)
+	subject := envelope.Envelope{
+		Name:    `TEST ENVELOPE`,
+		Prelude: `A prelude`,
+		Headers: map[string]string{
+			`Version`:    `1`,
+			`Curve`:      `x25519`,
+			`Request-ID`: `0b9a4a3e-5d7b-4f0c-9d1e-6a2b3c4d5e6f`,
+			`Expires`:    `2026-10-18T12:00:00Z`,
+		},
+		Data: []byte(`Headers: are not data`),
+	}
+	encoded, err := subject.MarshalText()
+	assert.NoError(err)
+	assert.Contains(string(encoded), "----- BEGIN TEST ENVELOPE -----\nVersion: 1\nCurve: x25519\n")
+
+	var recovered envelope.Envelope
+	assert.NoError(recovered.UnmarshalText(encoded), string(encoded))
+	assert.Equal(subject, recovered)
+
+	dec, err := envelope.NewDecoder(bytes.NewReader(encoded))
+	assert.NoError(err)
+	assert.Equal(subject.Headers, dec.Headers)
+	streamed, err := dec.Envelope()
+	assert.NoError(err)
+	assert.Equal(subject.Data, streamed.Data)
+
+	// Long values may be folded onto lines that begin with white space.
+	folded := bytes.Replace(encoded, []byte("Curve: x25519\n"), []byte("Curve: x25519\n  and more\n"), 1)
+	assert.NoError(recovered.UnmarshalText(folded))
+	assert.Equal(`x25519 and more`, recovered.Headers[`Curve`])
+
+	subject.Headers[`Bad: Name`] = `value`
+	_, err = subject.MarshalText()
+	assert.Error(err)
+	delete(subject.Headers, `Bad: Name`)
+	subject.Headers[`Name`] = "two\nlines"
+	_, err = subject.MarshalText()
+	assert.Error(err)
+}
+
+func TestScanner(t *testing.T) {
+	assert := assert.New(t)
+	thread := new(bytes.Buffer)
+	thread.WriteString("On Monday, Alice wrote:\n")
+	for i, data := range []string{`first`, `second`, `third`} {
+		text, err := envelope.Envelope{Name: `TEST ENVELOPE`, Prelude: fmt.Sprint(`Envelope `, i), Data: []byte(data)}.MarshalText()
+		assert.NoError(err)
+		thread.Write(text)
+	}
+	thread.WriteString("Thanks!\n")
+
+	scanner := envelope.NewScanner(bytes.NewReader(thread.Bytes()))
+	assert.True(scanner.Scan())
+	env, err := scanner.Envelope()
+	assert.NoError(err)
+	assert.Equal("On Monday, Alice wrote:\nEnvelope 0", env.Prelude)
+	assert.Equal(`first`, string(env.Data))
+
+	// An envelope need not be read before the next is scanned.
+	assert.True(scanner.Scan())
+	assert.Equal(`Envelope 1`, scanner.Decoder().Prelude)
+
+	assert.True(scanner.Scan())
+	data, err := io.ReadAll(scanner.Decoder())
+	assert.NoError(err)
+	assert.Equal(`third`, string(data))
+
+	assert.False(scanner.Scan())
+	assert.NoError(scanner.Err())
+	assert.Nil(scanner.Decoder())
+	assert.Equal(`Thanks!`, scanner.Postlude())
+
+	// Damage to an envelope that is skipped is still reported, but does not
+	// stop the envelopes after it from being read.
+	damaged := bytes.Replace(thread.Bytes(), []byte("----- END TEST ENVELOPE -----"), []byte("AAAA\n----- END TEST ENVELOPE -----"), 1)
+	scanner = envelope.NewScanner(bytes.NewReader(damaged))
+	assert.True(scanner.Scan())
+	_, err = scanner.Envelope()
+	assert.ErrorIs(err, envelope.ErrDamaged)
+	for _, data := range []string{`second`, `third`} {
+		assert.True(scanner.Scan())
+		env, err := scanner.Envelope()
+		assert.NoError(err)
+		assert.Equal(data, string(env.Data))
+	}
+	assert.False(scanner.Scan())
+	assert.NoError(scanner.Err())
+	if assert.Len(scanner.Skipped(), 1) {
+		assert.ErrorIs(scanner.Skipped()[0], envelope.ErrDamaged)
+		assert.ErrorContains(scanner.Skipped()[0], `the TEST ENVELOPE at line 3`)
+	}
+
+	// So does an envelope whose data cannot be begun, which Scan passes
+	// over by itself.
+	lines := strings.Split(thread.String(), "\n")
+	lines[3] = `AAAA` + lines[3][4:]
+	scanner = envelope.NewScanner(strings.NewReader(strings.Join(lines, "\n")))
+	for _, data := range []string{`second`, `third`} {
+		assert.True(scanner.Scan())
+		env, err := scanner.Envelope()
+		assert.NoError(err)
+		assert.Equal(data, string(env.Data))
+	}
+	assert.False(scanner.Scan())
+	assert.NoError(scanner.Err())
+	assert.Len(scanner.Skipped(), 1)
+
+	scanner = envelope.NewScanner(strings.NewReader("No envelopes here.\n"))
+	assert.False(scanner.Scan())
+	assert.NoError(scanner.Err())
+	assert.Equal(`No envelopes here.`, scanner.Postlude())
+}
+
+func TestScannerOtherArmor(t *testing.T) {
+	const (
+		signature = "-----BEGIN PGP SIGNATURE-----\n" +
+			"\n" +
+			"iHUEARYKAB0WIQTn9ExampleSignatureBlockThatIsNotRealAAoJEExample\n" +
+			"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA==\n" +
+			"=Qm9i\n" +
+			"-----END PGP SIGNATURE-----\n"
+		certificate = "-----BEGIN CERTIFICATE-----\n" +
+			"MIIBszCCAVmgAwIBAgIUExampleCertificateThatIsNotRealAAAAAAAAAAAA\n" +
+			"BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB=\n" +
+			"-----END CERTIFICATE-----\n"
+	)
+	for _, c := range []struct {
+		name  string
+		armor string
+	}{
+		{`signed mail`, "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256\n\n" + signature},
+		{`certificate`, "Here is the CA certificate:\n" + certificate},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert.New(t)
+			thread := new(bytes.Buffer)
+			for i, data := range []string{`first`, `second`} {
+				text, err := envelope.Envelope{Name: `RESPONSE`, Data: []byte(data)}.MarshalText()
+				assert.NoError(err)
+				thread.Write(text)
+				if i == 0 {
+					thread.WriteString(c.armor)
+				}
+			}
+
+			scanner := envelope.NewScanner(bytes.NewReader(thread.Bytes()))
+			for _, data := range []string{`first`, `second`} {
+				if !assert.True(scanner.Scan()) {
+					break
+				}
+				env, err := scanner.Envelope()
+				assert.NoError(err)
+				assert.Equal(data, string(env.Data))
+			}
+			assert.False(scanner.Scan())
+			assert.NoError(scanner.Err())
+			assert.Empty(scanner.Repairs())
+		})
+	}
+}
+
+func TestRepairChecksumLikeQuotedPrintable(t *testing.T) {
+	assert := assert.New(t)
+	// The checksum line of this clean envelope begins with =3D by chance,
+	// which is not a sign of quoted-printable encoding.
+	const text = "----- BEGIN TEST ENVELOPE -----\n" +
+		"eNpKzkhNzi4uzVUwtLS0AAwAIf4ETw==\n" +
+		"=3DESd\n" +
+		"----- END TEST ENVELOPE -----\n"
+	var env envelope.Envelope
+	assert.NoError(env.UnmarshalText([]byte(text)))
+	assert.Equal(`checksum 1998`, string(env.Data))
+	assert.Empty(env.Repairs)
+
+	// Nor is it a sign for the envelopes that follow.
+	scanner := envelope.NewScanner(strings.NewReader(text + text))
+	for range 2 {
+		assert.True(scanner.Scan())
+		env, err := scanner.Envelope()
+		assert.NoError(err)
+		assert.Equal(`checksum 1998`, string(env.Data))
+	}
+	assert.False(scanner.Scan())
+	assert.NoError(scanner.Err())
+	assert.Empty(scanner.Repairs())
+}
+
+func TestCompact(t *testing.T) {
+	assert := assert.New(t)
+	subject := envelope.Envelope{Name: `PUBLIC REQUEST`, Data: []byte(`compact envelopes are single lines`)}
+	b32, err := subject.Bech32()
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(b32, `ephpub1`), b32)
+	b64, err := subject.Base64URL()
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(b64, `ephpub:`), b64)
+
+	for _, text := range []string{
+		b32,
+		strings.ToUpper(b32),
+		b64,
+		`https://example.com/respond?public=` + b64 + `&expires=0`,
+		"Here is my key: " + b32 + " thanks!\n",
+	} {
+		var recovered envelope.Envelope
+		assert.NoError(recovered.UnmarshalText([]byte(text)), text)
+		assert.Equal(subject.Name, recovered.Name)
+		assert.Equal(subject.Data, recovered.Data)
+	}
+
+	// Only the envelopes that this package writes have compact forms, but
+	// they may also be named in full.
+	_, err = envelope.Envelope{Name: `TEST ENVELOPE`, Data: []byte(`data`)}.Bech32()
+	assert.Error(err)
+	long := `eph-public-request` + b64[len(`ephpub`):]
+	var recovered envelope.Envelope
+	assert.NoError(recovered.UnmarshalText([]byte(long)))
+	assert.Equal(subject.Data, recovered.Data)
+
+	// Compact and armored envelopes can be mixed, and text that only looks
+	// like a compact envelope, such as one cut short, is left alone.
+	armored, err := subject.MarshalText()
+	assert.NoError(err)
+	other, err := envelope.Envelope{Name: `RESPONSE`, Data: []byte(`data`)}.Bech32()
+	assert.NoError(err)
+	text := b32[:len(b32)-10] + " was cut short, and eph-word:abcdef is not one.\n" + b32 + "\n" + string(armored) + other + "\n"
+	scanner := envelope.NewScanner(strings.NewReader(text))
+	var names []string
+	for scanner.Scan() {
+		env, err := scanner.Envelope()
+		assert.NoError(err)
+		names = append(names, env.Name)
+	}
+	assert.NoError(scanner.Err())
+	assert.Empty(scanner.Skipped())
+	assert.Equal([]string{`PUBLIC REQUEST`, `PUBLIC REQUEST`, `RESPONSE`}, names)
+
+	// A mistyped character is caught by the checksum.
+	for _, damaged := range []string{
+		b32[:20] + string(b32[21]) + string(b32[20]) + b32[22:],
+		b64[:20] + string(b64[21]) + string(b64[20]) + b64[22:],
+	} {
+		var recovered envelope.Envelope
+		assert.ErrorIs(recovered.UnmarshalText([]byte(damaged)), envelope.ErrDamaged, damaged)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * i * i)
+	}
+	subject := envelope.Envelope{
+		Name:    `TEST ENVELOPE`,
+		Prelude: "Two lines\nof prelude",
+		Headers: map[string]string{`Version`: `1`},
+		Data:    data,
+	}
+	encoded, err := subject.MarshalText()
+	assert.NoError(err)
+	lines := strings.Split(string(encoded), "\n")
+	// The prelude, BEGIN, a header and a blank line come before the data.
+	assert.Equal(`----- BEGIN TEST ENVELOPE -----`, lines[2])
+	assert.Regexp(`^=[A-Za-z0-9+/]{4}`, lines[len(lines)-4])
+
+	damage := func(line int, change func(string) string) []byte {
+		damaged := append([]string{}, lines...)
+		damaged[line-1] = change(damaged[line-1])
+		return []byte(strings.Join(damaged, "\n"))
+	}
+	check := func(text []byte, message string) {
+		t.Helper()
+		var recovered envelope.Envelope
+		err := recovered.UnmarshalText(text)
+		assert.ErrorIs(err, envelope.ErrDamaged)
+		assert.ErrorContains(err, message)
+
+		dec, err := envelope.NewDecoder(bytes.NewReader(text))
+		if err == nil {
+			_, err = io.ReadAll(dec)
+		}
+		assert.ErrorIs(err, envelope.ErrDamaged)
+		assert.ErrorContains(err, message)
+	}
+
+	// A swapped character is found, on the line where it was swapped.
+	check(damage(9, func(s string) string {
+		if s[10] == 'A' {
+			return s[:10] + `B` + s[11:]
+		}
+		return s[:10] + `A` + s[11:]
+	}), `line 9 does not match`)
+	// So is a lost one, even though the data can no longer be decoded.
+	check(damage(8, func(s string) string { return s[:20] + s[21:] }), `line 8 does not match`)
+	// And one that cannot be in base64 at all.
+	check(damage(7, func(s string) string { return s[:5] + `*` + s[6:] }), `line 7 has a character`)
+	// A lost line is counted.
+	check(damage(10, func(string) string { return `` }), `a line was added or lost`)
+
+	// Envelopes without a checksum can still be read.
+	var unchecked []string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, `=`) {
+			unchecked = append(unchecked, line)
+		}
+	}
+	var recovered envelope.Envelope
+	assert.NoError(recovered.UnmarshalText([]byte(strings.Join(unchecked, "\n"))))
+	assert.Equal(data, recovered.Data)
+
+	// A streamed envelope has only the checksum of the whole data.
+	buff := new(bytes.Buffer)
+	enc := envelope.NewEncoder(buff, `test envelope`, ``)
+	_, err = enc.Write(data)
+	assert.NoError(err)
+	assert.NoError(enc.Close())
+	assert.Regexp("\n=[A-Za-z0-9+/]{4}\n-----", buff.String())
+	lines = strings.Split(buff.String(), "\n")
+	check(damage(4, func(s string) string {
+		if s[10] == 'A' {
+			return s[:10] + `B` + s[11:]
+		}
+		return s[:10] + `A` + s[11:]
+	}), `does not match its checksum`)
+}
+
+func TestRepair(t *testing.T) {
+	data := make([]byte, 500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	subject := envelope.Envelope{
+		Name:    `RESPONSE`,
+		Prelude: `Here is your secret`,
+		Headers: map[string]string{`Version`: `1`, `Request-ID`: `f00`},
+		Data:    data,
+	}
+	encoded, err := subject.MarshalText()
+	assert.NoError(t, err)
+	text := strings.TrimSpace(string(encoded))
+	lines := strings.Split(text, "\n")
+	each := func(change func(string) string) string {
+		changed := make([]string, len(lines))
+		for i, line := range lines {
+			changed[i] = change(line)
+		}
+		return strings.Join(changed, "\n")
+	}
+	qp := new(bytes.Buffer)
+	w := quotedprintable.NewWriter(qp)
+	_, err = w.Write([]byte(text))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	for _, c := range []struct {
+		name   string
+		text   string
+		repair string
+	}{
+		{`clean`, text, ``},
+		{`windows`, strings.ReplaceAll(text, "\n", "\r\n"), `converted Windows line endings`},
+		{`quoted`, each(func(s string) string { return `> ` + s }), `removed > quote marks`},
+		{`quoted twice`, each(func(s string) string { return `> >` + s }), `removed > quote marks`},
+		{`fenced`, "```text\n" + text + "\n```", `removed code fences`},
+		{`indented`, each(func(s string) string { return `    ` + s }), `removed indentation`},
+		{`zero width`, strings.ReplaceAll(text, `A`, "A​"), `removed invisible characters, such as zero-width spaces`},
+		{`em dashes`, strings.ReplaceAll(text, `-----`, "——"), `rewrote the BEGIN RESPONSE line`},
+		{`en dashes`, strings.ReplaceAll(text, `-----`, "–--"), `rewrote the END RESPONSE line`},
+		{`quoted-printable`, qp.String(), `decoded quoted-printable text`},
+		{`one line`, strings.Join(lines, ` `), `restored line breaks in the data`},
+		{`two envelopes`, text + "\n\n" + text, `found more than one envelope, and read only the first`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert.New(t)
+			var recovered envelope.Envelope
+			if !assert.NoError(recovered.UnmarshalText([]byte(c.text)), c.text) {
+				return
+			}
+			assert.Equal(subject.Name, recovered.Name)
+			assert.Equal(subject.Headers, recovered.Headers)
+			assert.Equal(subject.Data, recovered.Data)
+			if c.repair == `` {
+				assert.Empty(recovered.Repairs)
+				assert.Equal(subject.Prelude, recovered.Prelude)
+			} else {
+				assert.Contains(recovered.Repairs, c.repair)
+			}
+		})
+	}
+}
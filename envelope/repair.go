@@ -0,0 +1,338 @@
+package envelope
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// repairState is where in an envelope the repairer is.
+type repairState uint8
+
+const (
+	outside repairState = iota
+	inHeaders
+	inData
+)
+
+var (
+	// markerPattern finds BEGIN and END lines, even once a word processor
+	// has turned their dashes into en or em dashes. It also finds the
+	// markers of PEM and PGP armor, which findMarker passes over.
+	markerPattern = regexp.MustCompile(`([-\x{2010}-\x{2015}\x{2212}]{2,})([ \t]*)(?i:(BEGIN|END))[ \t]+([A-Za-z][A-Za-z ]*?)[ \t]*([-\x{2010}-\x{2015}\x{2212}]{2,})`)
+
+	// quotePattern finds the marks that mail programs put in front of
+	// quoted lines.
+	quotePattern = regexp.MustCompile(`^[ \t]*>(?:[ \t]*>)*[ \t]?`)
+
+	// fencePattern finds the lines that open and close Markdown code blocks.
+	fencePattern = regexp.MustCompile("^[ \t]*(?:```|~~~)[\\w-]*[ \t]*$")
+
+	// escapePattern finds quoted-printable escapes.
+	escapePattern = regexp.MustCompile(`=[0-9A-Fa-f]{2}`)
+)
+
+// invisible maps the characters that chat clients and word processors add
+// to text without showing them.
+func invisible(r rune) rune {
+	switch r {
+	case '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff', '\u00ad':
+		return -1
+	case '\u00a0', '\u202f':
+		return ' '
+	}
+	return r
+}
+
+// repairer undoes, a line at a time, what chat clients, mail programs and
+// word processors do to envelopes pasted into them, and notes what it did.
+type repairer struct {
+	state   repairState
+	header  bool
+	indent  string
+	qp      bool
+	pending string
+
+	// compactErr is why the first text that looked like a compact envelope
+	// could not be decoded.
+	compactErr error
+
+	noted   map[string]bool
+	repairs []string
+}
+
+func (r *repairer) note(repair string) {
+	if r.noted == nil {
+		r.noted = make(map[string]bool)
+	}
+	if !r.noted[repair] {
+		r.noted[repair] = true
+		r.repairs = append(r.repairs, repair)
+	}
+}
+
+// repair returns the lines that a line of text should have been. A line
+// that is removed becomes an empty line, so that the lines after it keep
+// their numbers.
+func (r *repairer) repair(line string) []string {
+	line = strings.TrimSuffix(line, "\n")
+	if strings.HasSuffix(line, "\r") {
+		line = strings.TrimSuffix(line, "\r")
+		r.note(`converted Windows line endings`)
+	}
+	if strings.Contains(line, "\r") {
+		r.note(`restored line breaks from carriage returns`)
+		var lines []string
+		for _, piece := range strings.Split(line, "\r") {
+			lines = append(lines, r.repair(piece)...)
+		}
+		return lines
+	}
+	if cleaned := strings.Map(invisible, line); cleaned != line {
+		line = cleaned
+		r.note(`removed invisible characters, such as zero-width spaces`)
+	}
+
+	if !r.qp && r.quotedPrintable(line) {
+		r.qp = true
+		r.note(`decoded quoted-printable text`)
+	}
+	if r.qp {
+		line = r.pending + line
+		r.pending = ``
+		if strings.HasSuffix(line, `=`) {
+			r.pending = strings.TrimSuffix(line, `=`)
+			return nil
+		}
+		line = escapePattern.ReplaceAllStringFunc(line, func(escape string) string {
+			b, _ := strconv.ParseUint(escape[1:], 16, 8)
+			return string([]byte{byte(b)})
+		})
+	}
+
+	if quote := quotePattern.FindString(line); quote != `` {
+		line = line[len(quote):]
+		if r.state != outside || findMarker(line) != nil {
+			r.note(`removed > quote marks`)
+		}
+	}
+	if fencePattern.MatchString(line) {
+		r.note(`removed code fences`)
+		return []string{``}
+	}
+	if loc := findMarker(line); loc != nil {
+		return r.marker(line, loc)
+	}
+	if r.state == outside {
+		if lines, ok := r.compact(line); ok {
+			return lines
+		}
+	}
+	return r.content(line)
+}
+
+// compact expands the first compact envelope in line into an armored one,
+// and splits it from the text around it. It returns false if there is none.
+// Text that only looks like a compact envelope, such as one that was cut
+// short, is left as it is, and the reason it could not be decoded is kept
+// in case no envelope is found at all.
+func (r *repairer) compact(line string) ([]string, bool) {
+	var (
+		loc      []int
+		expanded []string
+	)
+	for _, found := range findCompact(line) {
+		var err error
+		if expanded, err = expandCompact(line[found[0]:found[1]]); err == nil {
+			loc = found
+			break
+		} else if r.compactErr == nil {
+			r.compactErr = err
+		}
+	}
+	if loc == nil {
+		return nil, false
+	}
+	var lines []string
+	if before := strings.TrimSpace(line[:loc[0]]); before != `` {
+		lines = append(lines, before)
+	}
+	lines = append(lines, expanded...)
+	if after := strings.TrimSpace(line[loc[1]:]); after != `` {
+		lines = append(lines, r.repair(after)...)
+	}
+	return lines, true
+}
+
+// quotedPrintable reports whether a line shows the signs of quoted-printable
+// encoding: a soft line break outside an envelope, or an escaped = inside
+// one. Envelopes have no = but in padding, which quoted-printable writes as
+// =3D, and in checksum lines, which begin with it. A checksum line may begin
+// with =3D itself, so lines that begin with = are never taken as a sign.
+// Nor is the padding at the end of a line of other armor, such as a PGP
+// signature or a PEM certificate, outside an envelope.
+func (r *repairer) quotedPrintable(line string) bool {
+	if strings.HasPrefix(strings.TrimSpace(line), `=`) {
+		return false
+	}
+	if r.state == outside {
+		return strings.HasSuffix(line, `=`) && !isBase64(strings.Fields(line))
+	}
+	return strings.Contains(line, `=3D`)
+}
+
+// content repairs a line that is not a BEGIN or END line, according to
+// where in an envelope it is.
+func (r *repairer) content(line string) []string {
+	switch r.state {
+	case inHeaders:
+		line = r.dedent(line)
+		trimmed := strings.TrimSpace(line)
+		if headers, rest, ok := runTogether(trimmed); ok {
+			r.note(`restored line breaks in the headers`)
+			r.state = inData
+			return append(append(headers, ``), r.content(rest)...)
+		}
+		continues := r.header && trimmed != `` && (line[0] == ' ' || line[0] == '\t')
+		if r.header = trimmed != `` && (continues || strings.Contains(trimmed, `:`)); r.header || trimmed == `` {
+			return []string{line}
+		}
+		r.state = inData
+		fallthrough
+	case inData:
+		fields := strings.Fields(line)
+		if len(fields) > 1 && isBase64(fields) {
+			r.note(`restored line breaks in the data`)
+			return fields
+		}
+		return []string{r.dedent(line)}
+	}
+	return []string{line}
+}
+
+// findMarker locates the first BEGIN or END line of an envelope in line, or
+// returns nil. PEM and PGP armor, such as -----BEGIN PGP SIGNATURE-----, has
+// no space inside its dashes, so such a marker is only taken for an
+// envelope's if its dashes were mangled, or it has the name of one that is
+// written by this package.
+func findMarker(line string) []int {
+	for _, loc := range markerPattern.FindAllStringSubmatchIndex(line, -1) {
+		dashes := line[loc[2]:loc[3]] + line[loc[10]:loc[11]]
+		name := strings.ToUpper(strings.Join(strings.Fields(line[loc[8]:loc[9]]), ` `))
+		if _, known := compactNames[name]; known || loc[5] > loc[4] || strings.Trim(dashes, `-`) != `` {
+			return loc
+		}
+	}
+	return nil
+}
+
+// marker rewrites a BEGIN or END line, which loc locates in line, and splits
+// off any text that has been run into it.
+func (r *repairer) marker(line string, loc []int) []string {
+	keyword := strings.ToUpper(line[loc[6]:loc[7]])
+	name := strings.ToUpper(strings.Join(strings.Fields(line[loc[8]:loc[9]]), ` `))
+	canonical := fmt.Sprintf(`----- %s %s -----`, keyword, name)
+	before := strings.Trim(line[:loc[0]], "` \t")
+	after := strings.Trim(line[loc[1]:], "` \t")
+	if line[loc[0]:loc[1]] != canonical {
+		r.note(fmt.Sprintf(`rewrote the %s %s line`, keyword, name))
+	}
+
+	var lines []string
+	if before != `` || after != `` {
+		r.note(fmt.Sprintf(`restored line breaks around the %s %s line`, keyword, name))
+	}
+	if before != `` {
+		lines = append(lines, r.content(before)...)
+	}
+	switch keyword {
+	case `BEGIN`:
+		r.state = inHeaders
+		r.header = false
+		r.indent = ``
+		if indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]; indent != `` && before == `` {
+			r.indent = indent
+			r.note(`removed indentation`)
+		}
+	case `END`:
+		r.state = outside
+		r.indent = ``
+		r.qp = false
+	}
+	lines = append(lines, canonical)
+	if after != `` {
+		lines = append(lines, r.repair(after)...)
+	}
+	return lines
+}
+
+// runTogether splits headers, and perhaps the data, that have lost the line
+// breaks between them. Each header is taken to have a value of one word, as
+// all of those that are written do. A single header with a value of several
+// words is left alone.
+func runTogether(line string) ([]string, string, bool) {
+	fields := strings.Fields(line)
+	var headers []string
+	for len(fields) >= 2 && strings.HasSuffix(fields[0], `:`) {
+		headers = append(headers, fields[0]+` `+fields[1])
+		fields = fields[2:]
+	}
+	if len(headers) == 0 || len(headers) == 1 && (len(fields) == 0 || !isBase64(fields) || len(fields[0]) < 16) {
+		return nil, ``, false
+	}
+	return headers, strings.Join(fields, ` `), true
+}
+
+// dedent removes the indentation of the BEGIN line from a line inside the
+// envelope.
+func (r *repairer) dedent(line string) string {
+	return strings.TrimPrefix(line, r.indent)
+}
+
+// isBase64 reports whether every field could be a line of data.
+func isBase64(fields []string) bool {
+	for _, field := range fields {
+		if strings.Trim(field, base64Alphabet+`=`) != `` {
+			return false
+		}
+	}
+	return true
+}
+
+// repairReader repairs text a line at a time as it is read.
+type repairReader struct {
+	r   *bufio.Reader
+	rep *repairer
+	buf []byte
+	err error
+}
+
+func newRepairReader(r io.Reader) *repairReader {
+	return &repairReader{r: bufio.NewReader(r), rep: new(repairer)}
+}
+
+func (rr *repairReader) Read(p []byte) (int, error) {
+	for len(rr.buf) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		line, err := rr.r.ReadString('\n')
+		rr.err = err
+		if line == `` && err != nil && rr.rep.pending != `` {
+			line, rr.rep.pending = rr.rep.pending, ``
+		}
+		if line == `` {
+			continue
+		}
+		for _, repaired := range rr.rep.repair(line) {
+			rr.buf = append(rr.buf, repaired...)
+			rr.buf = append(rr.buf, '\n')
+		}
+	}
+	n := copy(p, rr.buf)
+	rr.buf = rr.buf[n:]
+	return n, nil
+}
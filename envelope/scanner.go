@@ -0,0 +1,122 @@
+package envelope
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Scanner reads every envelope in a text, such as an email thread or a file
+// that holds many of them, along with the text around them. Each envelope's
+// prelude is the text between it and the one before, and the text after the
+// last is returned by Postlude.
+//
+// Like a Decoder, a Scanner repairs the text as it reads it. An envelope
+// that cannot be read is passed over, and its error is kept for Skipped, so
+// that one damaged envelope does not hide the rest.
+type Scanner struct {
+	r        *bufio.Reader
+	rep      *repairer
+	number   int
+	dec      *Decoder
+	postlude string
+	skipped  []error
+	err      error
+}
+
+// NewScanner returns a Scanner that reads envelopes from r.
+func NewScanner(r io.Reader) *Scanner {
+	repaired := newRepairReader(r)
+	return &Scanner{r: bufio.NewReader(repaired), rep: repaired.rep}
+}
+
+// Scan advances to the next envelope, reading past whatever is left of the
+// one before. If that envelope, or any before the next, cannot be read, it
+// is passed over, and its error is added to Skipped. Scan returns false when
+// there are no more envelopes, or if an error stopped it, which Err returns.
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	if s.dec != nil {
+		if _, err := io.Copy(io.Discard, s.dec); err != nil {
+			s.pass(s.dec, err)
+		}
+		s.number = s.dec.lines.number
+		s.dec = nil
+	}
+	for {
+		prelude, name, number, err := readPrelude(s.r, s.number)
+		if err == errNoBegin {
+			s.postlude = prelude
+			return false
+		} else if err != nil {
+			s.err = err
+			return false
+		}
+		dec, err := begin(s.r, s.rep, name, prelude, number)
+		if err == nil {
+			s.dec = dec
+			return true
+		} else if dec == nil {
+			s.err = err
+			return false
+		}
+		s.pass(dec, err)
+		s.number = dec.lines.number
+	}
+}
+
+// pass keeps the error that an envelope could not be read with, and skips
+// to its END line.
+func (s *Scanner) pass(d *Decoder, err error) {
+	s.skipped = append(s.skipped, fmt.Errorf(`the %s at line %d: %w`, d.Name, d.number, err))
+	d.lines.skip()
+}
+
+// Decoder returns the current envelope for reading as a stream. It is nil
+// before the first call to Scan, and after the last.
+func (s *Scanner) Decoder() *Decoder {
+	return s.dec
+}
+
+// Envelope reads the whole of the current envelope. Its postlude is empty;
+// the text after it is the prelude of the next one, or the Postlude of the
+// Scanner. If it cannot be read, the error is returned, and is also added
+// to Skipped by the next call to Scan, which passes over the envelope.
+func (s *Scanner) Envelope() (Envelope, error) {
+	data, err := io.ReadAll(s.dec)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Name:    s.dec.Name,
+		Prelude: s.dec.Prelude,
+		Headers: s.dec.Headers,
+		Data:    data,
+		Repairs: s.Repairs(),
+	}, nil
+}
+
+// Err returns the error, if any, that stopped the Scanner. Reaching the end
+// of the text is not an error, nor is an envelope that was passed over.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Skipped returns the errors of the envelopes that were passed over because
+// they could not be read, such as damaged ones.
+func (s *Scanner) Skipped() []error {
+	return s.skipped
+}
+
+// Postlude returns the text after the last envelope, once Scan has returned
+// false. If there were no envelopes, it is the whole text.
+func (s *Scanner) Postlude() string {
+	return s.postlude
+}
+
+// Repairs lists what had to be repaired in the text read so far.
+func (s *Scanner) Repairs() []string {
+	return s.rep.repairs
+}
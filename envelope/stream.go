@@ -0,0 +1,442 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Unquabain/ephemeral/wire"
+)
+
+// lineWriter wraps the base64 text at wrapLength columns as it is written.
+// If check is set, it notes the check character of each line.
+type lineWriter struct {
+	w      io.Writer
+	ll     int
+	check  bool
+	crc    uint32
+	checks []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := min(wrapLength-l.ll, len(p))
+		if _, err := l.w.Write(p[:c]); err != nil {
+			return n, fmt.Errorf(`could not wrap data: %w`, err)
+		}
+		if l.check {
+			if l.ll == 0 {
+				l.crc = crc24Init
+			}
+			l.crc = crc24(l.crc, p[:c])
+		}
+		n += c
+		l.ll += c
+		p = p[c:]
+		if l.ll == wrapLength {
+			if err := l.end(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// end finishes the last, partial line.
+func (l *lineWriter) end() error {
+	if l.ll == 0 {
+		return nil
+	}
+	l.ll = 0
+	if l.check {
+		l.checks = append(l.checks, base64Alphabet[l.crc&63])
+	}
+	if _, err := io.WriteString(l.w, "\n"); err != nil {
+		return fmt.Errorf(`could not wrap data: %w`, err)
+	}
+	return nil
+}
+
+// Encoder writes an envelope without holding its data in memory. Anything
+// written to it is compressed, encoded and wrapped on its way to the
+// underlying writer. Its checksum has no check characters for the lines,
+// since they would have to be held until the end.
+type Encoder struct {
+	// Headers are written after the BEGIN line, and must be set before
+	// anything is written.
+	Headers map[string]string
+
+	// Postlude is written after the END line, and must be set before Close.
+	Postlude string
+
+	name    string
+	started bool
+	w       *bufio.Writer
+	lines   *lineWriter
+	base64  io.WriteCloser
+	zip     *zlib.Writer
+	sum     *checksum
+}
+
+// NewEncoder returns an Encoder that writes an envelope with the given name
+// and prelude to w. Close must be called to finish the envelope. It does
+// not close w.
+func NewEncoder(w io.Writer, name, prelude string) *Encoder {
+	return newEncoder(w, name, prelude, zlib.BestSpeed, false)
+}
+
+// newEncoder returns an Encoder that compresses at the given level, and
+// writes the check character of each line if check is set.
+func newEncoder(w io.Writer, name, prelude string, level int, check bool) *Encoder {
+	buffered := bufio.NewWriter(w)
+	lines := &lineWriter{w: buffered, check: check}
+	b64 := base64.NewEncoder(base64.StdEncoding, lines)
+	sum := newChecksum()
+	zip, _ := zlib.NewWriterLevel(io.MultiWriter(b64, sum), level)
+	fmt.Fprintln(buffered, prelude)
+	return &Encoder{
+		name:   strings.ToUpper(name),
+		w:      buffered,
+		lines:  lines,
+		base64: b64,
+		zip:    zip,
+		sum:    sum,
+	}
+}
+
+func (e *Encoder) Write(p []byte) (int, error) {
+	if !e.started {
+		e.started = true
+		if _, err := fmt.Fprintf(e.w, "----- BEGIN %s -----\n", e.name); err != nil {
+			return 0, err
+		}
+		if err := writeHeaders(e.w, e.Headers); err != nil {
+			return 0, err
+		}
+	}
+	return e.zip.Write(p)
+}
+
+// Close finishes the data and writes the end of the envelope.
+func (e *Encoder) Close() error {
+	if _, err := e.Write(nil); err != nil {
+		return err
+	}
+	if err := e.zip.Close(); err != nil {
+		return fmt.Errorf(`could not finalize compressed data: %w`, err)
+	}
+	if err := e.base64.Close(); err != nil {
+		return fmt.Errorf(`could not finalize encoding: %w`, err)
+	}
+	if err := e.lines.end(); err != nil {
+		return err
+	}
+	if err := writeChecksum(e.w, e.sum.crc, e.lines.checks); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.w, "----- END %s -----\n", e.name)
+	fmt.Fprintln(e.w, e.Postlude)
+	return e.w.Flush()
+}
+
+// lineReader returns the base64 text of an envelope, with the line breaks
+// removed, up to the END line. It checks each line as it goes, and collects
+// the checksum lines that follow the data.
+type lineReader struct {
+	r      *bufio.Reader
+	line   []byte
+	next   []byte
+	done   bool
+	number int
+	sum    *checksum
+
+	// data is the decoded data, which is added to the checksum as it is
+	// read.
+	data io.Reader
+
+	finished bool
+	err      error
+}
+
+// newLineReader returns a lineReader for the data lines of r. The line
+// before the first of them is line number of the text.
+func newLineReader(r *bufio.Reader, number int) *lineReader {
+	l := &lineReader{r: r, number: number, sum: newChecksum()}
+	l.data = io.TeeReader(base64.NewDecoder(base64.StdEncoding, l), l.sum)
+	return l
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	for len(l.line) == 0 {
+		if l.done {
+			return 0, io.EOF
+		}
+		line, err := l.next, error(nil)
+		if line == nil {
+			line, err = l.r.ReadBytes('\n')
+		}
+		l.next = nil
+		if err == io.EOF && len(line) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil && err != io.EOF {
+			return 0, err
+		}
+		l.number++
+		line = bytes.TrimSpace(line)
+		switch {
+		case bytes.HasPrefix(line, []byte(`-----`)):
+			l.done = true
+		case bytes.HasPrefix(line, []byte(`=`)):
+			l.sum.trailer = append(l.sum.trailer, string(line[1:]))
+		case len(line) > 0:
+			if err := l.sum.line(l.number, line); err != nil {
+				return 0, err
+			}
+			l.line = line
+		}
+	}
+	n := copy(p, l.line)
+	l.line = l.line[n:]
+	return n, nil
+}
+
+// skip reads past the rest of the data, up to the END line, without checking
+// it, so that the envelopes after a damaged one can still be read.
+func (l *lineReader) skip() {
+	l.line = nil
+	for !l.done {
+		line, err := l.next, error(nil)
+		if line == nil {
+			line, err = l.r.ReadBytes('\n')
+		}
+		l.next = nil
+		if len(line) > 0 {
+			l.number++
+			l.done = bytes.HasPrefix(bytes.TrimSpace(line), []byte(`-----`))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// finish reads to the end of the data, and checks it against its checksum.
+// If the base64 could not be decoded, only the lines are checked, to find
+// the damage that caused it.
+func (l *lineReader) finish() error {
+	if l.finished {
+		return l.err
+	}
+	l.finished = true
+	decoded := true
+	if _, err := io.Copy(io.Discard, l.data); errors.Is(err, ErrDamaged) {
+		l.err = err
+		return err
+	} else if err != nil {
+		decoded = false
+		if _, err := io.Copy(io.Discard, l); err != nil {
+			l.err = err
+			return err
+		}
+	}
+	l.err = l.sum.verify(decoded)
+	return l.err
+}
+
+// readHeaders reads the headers that follow the BEGIN line, which is line
+// number of the text, and returns a lineReader for the data after them.
+func readHeaders(r *bufio.Reader, number int) (map[string]string, *lineReader, error) {
+	var h headerParser
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == ``) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+		if !h.parse(line) {
+			lines := newLineReader(r, number)
+			lines.next = []byte(line)
+			return h.headers, lines, nil
+		}
+		number++
+	}
+}
+
+// errNoBegin is returned by readPrelude when the text ends before another
+// BEGIN line.
+var errNoBegin = errors.New(`no BEGIN line found`)
+
+// readPrelude reads the text up to and including the next BEGIN line, and
+// returns the text before it and the name of the envelope. number is how
+// many lines have been read before, and the number of the BEGIN line is
+// returned. If there is no BEGIN line, the rest of the text is returned
+// along with errNoBegin.
+func readPrelude(r *bufio.Reader, number int) (string, string, int, error) {
+	prelude := new(strings.Builder)
+	for {
+		line, err := r.ReadString('\n')
+		number++
+		if name, ok := strings.CutPrefix(strings.TrimSpace(line), `----- BEGIN `); ok {
+			return strings.TrimSpace(prelude.String()), strings.TrimSpace(strings.TrimSuffix(name, `-----`)), number, nil
+		}
+		prelude.WriteString(line)
+		if err == io.EOF {
+			return strings.TrimSpace(prelude.String()), ``, number, errNoBegin
+		} else if err != nil {
+			return ``, ``, number, err
+		}
+	}
+}
+
+// Decoder reads an envelope without holding its data in memory. The name
+// and prelude are read when it is created, and reading from it returns the
+// data. The data is checked against its checksum when the end is reached.
+//
+// The text is repaired as it is read, of what chat clients, mail programs
+// and word processors do to envelopes pasted into them: quote marks, code
+// fences, Windows line endings, invisible characters, dashes turned into
+// em dashes, quoted-printable encoding and lost line breaks.
+type Decoder struct {
+	Name    string
+	Prelude string
+	Headers map[string]string
+	number  int
+	lines   *lineReader
+	data    io.Reader
+	rep     *repairer
+}
+
+// NewDecoder reads the beginning of an envelope from r, and returns a
+// Decoder to read the rest.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	repaired := newRepairReader(r)
+	buffered := bufio.NewReader(repaired)
+	prelude, name, number, err := readPrelude(buffered, 0)
+	if err == errNoBegin && repaired.rep.compactErr != nil {
+		return nil, repaired.rep.compactErr
+	} else if err != nil {
+		return nil, err
+	}
+	d, err := begin(buffered, repaired.rep, name, prelude, number)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// begin returns a Decoder for the envelope whose BEGIN line, line number of
+// the text, has just been read from r. If its headers were read, but its
+// data cannot be, the Decoder is returned along with the error, so that the
+// rest of the envelope can be skipped.
+func begin(r *bufio.Reader, rep *repairer, name, prelude string, number int) (*Decoder, error) {
+	headers, lines, err := readHeaders(r, number)
+	if err != nil {
+		return nil, err
+	}
+	d := &Decoder{
+		Name:    name,
+		Prelude: prelude,
+		Headers: headers,
+		number:  number,
+		lines:   lines,
+		rep:     rep,
+	}
+	if d.data, err = zlib.NewReader(lines.data); err != nil {
+		if err := lines.finish(); err != nil {
+			return d, err
+		}
+		return d, fmt.Errorf(`could not create new zlib reader: %w`, err)
+	}
+	return d, nil
+}
+
+func (d *Decoder) Read(p []byte) (int, error) {
+	n, err := d.data.Read(p)
+	if err != nil {
+		if err := d.lines.finish(); err != nil {
+			return n, err
+		}
+		if d.lines.sum.quoted {
+			d.rep.note(`decoded quoted-printable text`)
+		}
+	}
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf(`could not decompress data: %w`, err)
+	}
+	return n, err
+}
+
+// Repairs lists what had to be repaired in the text read so far, such as
+// "removed > quote marks".
+func (d *Decoder) Repairs() []string {
+	return d.rep.repairs
+}
+
+// Envelope reads the rest of the data, and the text after the END line,
+// and returns the whole envelope. If another envelope follows, its text is
+// not part of the postlude, and it is not read. Use a Scanner to read every
+// envelope in a text.
+func (d *Decoder) Envelope() (Envelope, error) {
+	data, err := io.ReadAll(d)
+	if err != nil {
+		return Envelope{}, err
+	}
+	postlude, _, _, err := readPrelude(d.lines.r, d.lines.number)
+	if err == nil {
+		d.rep.note(`found more than one envelope, and read only the first`)
+	} else if err != errNoBegin {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Name:     d.Name,
+		Prelude:  d.Prelude,
+		Headers:  d.Headers,
+		Data:     data,
+		Postlude: postlude,
+		Repairs:  d.Repairs(),
+	}, nil
+}
+
+// WriteContent serializes content to w, in a form that ReadContent can read
+// back without reading past it. This allows a header to be followed by a
+// stream of data in the same envelope.
+func WriteContent(w io.Writer, content any) error {
+	b, err := wire.Marshal(content)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// maxContentSize limits how much memory ReadContent will allocate.
+const maxContentSize = 16 * 1024 * 1024
+
+// ReadContent deserializes content written by WriteContent from r into
+// target, leaving r positioned just past it.
+func ReadContent(r io.Reader, target any) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return fmt.Errorf(`could not read content size: %w`, err)
+	}
+	if size > maxContentSize {
+		return fmt.Errorf(`content size %d is too large`, size)
+	}
+	buff := make([]byte, size)
+	if _, err := io.ReadFull(r, buff); err != nil {
+		return fmt.Errorf(`could not read content: %w`, err)
+	}
+	return wire.Unmarshal(buff, target)
+}
@@ -1,13 +1,19 @@
 module github.com/Unquabain/ephemeral
 
-go 1.21.4
+go 1.24
 
 require (
+	filippo.io/age v1.2.1
+	filippo.io/edwards25519 v1.1.0
 	github.com/apex/log v1.9.0
+	github.com/fxamacker/cbor/v2 v2.9.0
 	github.com/google/uuid v1.5.0
 	github.com/spf13/cobra v1.8.0
 	github.com/stretchr/testify v1.8.4
 	github.com/tj/assert v0.0.3
+	golang.org/x/crypto v0.40.0
+	golang.org/x/sys v0.34.0
+	golang.org/x/term v0.33.0
 )
 
 require (
@@ -16,5 +22,6 @@ require (
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
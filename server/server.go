@@ -5,18 +5,34 @@ import (
 	_ "embed"
 
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/Unquabain/ephemeral/data"
 	"github.com/Unquabain/ephemeral/envelope"
 	"github.com/apex/log"
+	"github.com/google/uuid"
 )
 
 //go:embed index.html
 var indexHTML []byte
 
+// Options configures the server.
+type Options struct {
+	// ShortExpiry is how long requests made by the short flow stay valid.
+	// Zero means they never expire.
+	ShortExpiry time.Duration
+
+	// Padding is how responses are padded when the caller does not say.
+	// The zero value is data.NoPadding.
+	Padding data.Padding
+}
+
+var options Options
+
 type webError struct {
 	error
 	code          int
@@ -52,16 +68,45 @@ func (r htmlResponse) Respond(w http.ResponseWriter) error {
 	return err
 }
 
-type textReaderResponse struct {
-	io.Reader
+// envelopeResponse writes an envelope as text, as it is encoded.
+type envelopeResponse struct {
+	envelope.Envelope
 }
 
-func (r textReaderResponse) Respond(w http.ResponseWriter) error {
+func (r envelopeResponse) Respond(w http.ResponseWriter) error {
 	w.Header().Add(`Content-Type`, `text/plain`)
-	_, err := io.Copy(w, r)
+	_, err := r.WriteTo(w)
 	return err
 }
 
+// repairedResponse tells the caller, in a Repairs header for each, what had
+// to be repaired to read the envelopes they gave, so that the page can warn
+// that they were mangled on the way.
+type repairedResponse struct {
+	response
+	repairs []string
+}
+
+func (r repairedResponse) Respond(w http.ResponseWriter) error {
+	for _, repair := range r.repairs {
+		w.Header().Add(`Repairs`, repair)
+	}
+	return r.response.Respond(w)
+}
+
+// withRepairs reports the repairs made to the given envelopes along with a
+// handler's response.
+func withRepairs(resp response, envs ...envelope.Envelope) response {
+	var repairs []string
+	for _, env := range envs {
+		repairs = append(repairs, env.Repairs...)
+	}
+	if resp == nil || len(repairs) == 0 {
+		return resp
+	}
+	return repairedResponse{resp, repairs}
+}
+
 type jsonResponse struct {
 	data any
 }
@@ -106,25 +151,68 @@ func serveError(err *webError, w http.ResponseWriter, r *http.Request) {
 func request(bodyInto getBody) (response, *webError) {
 	var requestData struct {
 		Description string
+		Curve       string
+		Hybrid      bool
+		Passphrase  string
+		Expires     string
 	}
 	var responseData struct {
 		PrivateRequest envelope.Envelope
 		PublicRequest  envelope.Envelope
+		Fingerprint    string
+		Code           string
 	}
 	if err := bodyInto(&requestData); err != nil {
 		return nil, werr(err, 400, `unable to parse request parameters`)
 	}
-	privateRequest, err := data.NewRequest(requestData.Description)
+	curve, err := data.ParseCurve(requestData.Curve)
+	if err != nil {
+		return nil, werr(err, 400, `unknown curve`)
+	}
+	privateRequest, err := data.NewCurveRequest(requestData.Description, curve)
 	if err != nil {
 		return nil, werr(err, 500, `unable to create new request`)
 	}
+	if requestData.Expires != `` {
+		if d, err := time.ParseDuration(requestData.Expires); err != nil {
+			return nil, werr(err, 400, `unable to understand expiry duration`)
+		} else {
+			privateRequest.ExpireAfter(d)
+		}
+	}
+	if requestData.Hybrid {
+		if err := privateRequest.MakeHybrid(); err != nil {
+			return nil, werr(err, 500, `unable to create hybrid request`)
+		}
+	}
+	fingerprint, err := privateRequest.Fingerprint()
+	if err != nil {
+		return nil, werr(err, 500, `unable to fingerprint request`)
+	}
+	responseData.Fingerprint = fingerprint.String()
+	responseData.Code = fingerprint.Code()
+	prelude, err := privateRequest.Prelude()
+	if err != nil {
+		return nil, werr(err, 500, `unable to fingerprint request`)
+	}
 	responseData.PrivateRequest.Name = `PRIVATE REQUEST`
-	responseData.PrivateRequest.Prelude = privateRequest.Description
-	if err := responseData.PrivateRequest.Stuff(privateRequest); err != nil {
+	responseData.PrivateRequest.Prelude = prelude
+	responseData.PrivateRequest.Headers = privateRequest.Headers()
+	if requestData.Passphrase == `` {
+		if err := responseData.PrivateRequest.Stuff(privateRequest); err != nil {
+			return nil, werr(err, 500, `unable to stuff private request envelope`)
+		}
+	} else if encrypted, err := privateRequest.Encrypt([]byte(requestData.Passphrase)); err != nil {
+		return nil, werr(err, 500, `unable to encrypt private request`)
+	} else if err := responseData.PrivateRequest.Stuff(encrypted); err != nil {
 		return nil, werr(err, 500, `unable to stuff private request envelope`)
+	} else {
+		responseData.PrivateRequest.Name = `ENCRYPTED PRIVATE REQUEST`
+		responseData.PrivateRequest.Headers = encrypted.Headers()
 	}
 	responseData.PublicRequest.Name = `PUBLIC REQUEST`
-	responseData.PublicRequest.Prelude = privateRequest.Description
+	responseData.PublicRequest.Prelude = prelude
+	responseData.PublicRequest.Headers = privateRequest.Headers()
 	if err := responseData.PublicRequest.Stuff(privateRequest.Public()); err != nil {
 		return nil, werr(err, 500, `unable to stuff public request envelope`)
 	}
@@ -132,54 +220,363 @@ func request(bodyInto getBody) (response, *webError) {
 	return jsonResponse{responseData}, nil
 }
 
-func respond(bodyInto getBody) (response, *webError) {
+// openRecipient opens a public or group request envelope, and returns
+// something a response can be encoded for, along with its description.
+func openRecipient(env envelope.Envelope) (data.Encoder, string, error) {
+	switch env.Name {
+	case `GROUP REQUEST`:
+		var group data.GroupRequest
+		if err := env.Open(&group); err != nil {
+			return nil, ``, err
+		}
+		return group, group.Description, nil
+	default:
+		var request data.PublicRequest
+		if err := env.Open(&request); err != nil {
+			return nil, ``, err
+		}
+		return request, request.Description, nil
+	}
+}
+
+func group(bodyInto getBody) (resp response, verr *webError) {
+	var (
+		requestData struct {
+			Description    string
+			PublicRequests []envelope.Envelope
+		}
+		members       []data.PublicRequest
+		groupEnvelope envelope.Envelope
+	)
+	if err := bodyInto(&requestData); err != nil {
+		return nil, werr(err, 400, `unable to understand request parameters`)
+	}
+	defer func() { resp = withRepairs(resp, requestData.PublicRequests...) }()
+	for _, env := range requestData.PublicRequests {
+		var request data.PublicRequest
+		if err := env.Open(&request); err != nil {
+			return nil, werr(err, 400, `unable to understand public request`)
+		}
+		members = append(members, request)
+	}
+	groupRequest, err := data.NewGroupRequest(requestData.Description, members...)
+	if err != nil {
+		return nil, werr(err, 400, `unable to create group request`)
+	}
+	groupEnvelope.Name = `GROUP REQUEST`
+	groupEnvelope.Prelude = groupRequest.Description
+	groupEnvelope.Headers = groupRequest.Headers()
+	if err := groupEnvelope.Stuff(groupRequest); err != nil {
+		return nil, werr(err, 500, `unable to stuff group request envelope`)
+	}
+	return envelopeResponse{groupEnvelope}, nil
+}
+
+// requestSummary describes who made a request, so that a responder can check
+// before encrypting anything for it.
+type requestSummary struct {
+	ID          string
+	Description string
+	Signer      string
+	Expires     *time.Time
+	Fingerprint string
+	Code        string
+}
+
+// verifyRequests checks the signature of every request that a response would
+// be encoded for.
+func verifyRequests(encoder data.Encoder) ([]requestSummary, *webError) {
+	var summaries []requestSummary
+	for _, request := range encoder.Requests() {
+		signer, err := request.Verify()
+		if err != nil {
+			return nil, werr(err, 400, `request signature is not valid`)
+		}
+		fingerprint, err := request.Fingerprint()
+		if err != nil {
+			return nil, werr(err, 400, `unable to fingerprint request`)
+		}
+		summary := requestSummary{
+			ID:          request.ID.String(),
+			Description: request.Description,
+			Fingerprint: fingerprint.String(),
+			Code:        fingerprint.Code(),
+		}
+		if signer != nil {
+			summary.Signer = signer.String()
+		}
+		if request.Expired(time.Now()) {
+			return nil, werr(fmt.Errorf(`request %s expired at %s`, request.ID, request.Expires), 410, `request has expired`)
+		}
+		if !request.Expires.IsZero() {
+			summary.Expires = &request.Expires
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+func verify(bodyInto getBody) (resp response, verr *webError) {
+	var requestData struct {
+		PublicRequest envelope.Envelope
+	}
+	if err := bodyInto(&requestData); err != nil {
+		return nil, werr(err, 400, `unable to understand request parameters`)
+	}
+	defer func() { resp = withRepairs(resp, requestData.PublicRequest) }()
+	publicRequest, _, err := openRecipient(requestData.PublicRequest)
+	if err != nil {
+		return nil, werr(err, 400, `unable to understand public request`)
+	}
+	summaries, verr := verifyRequests(publicRequest)
+	if verr != nil {
+		return nil, verr
+	}
+	return jsonResponse{summaries}, nil
+}
+
+func respond(bodyInto getBody) (resp response, verr *webError) {
 	var (
 		requestData struct {
 			PublicRequest envelope.Envelope
 			Data          string
+			Fields        data.Fields
+			Padding       string
+			Threshold     int
 		}
-		publicRequest    data.PublicRequest
 		responseEnvelope envelope.Envelope
+		plaintext        []byte
+		content          data.Content
 	)
 	if err := bodyInto(&requestData); err != nil {
 		return nil, werr(err, 400, `unable to understand request parameters`)
 	}
-	if err := requestData.PublicRequest.Open(&publicRequest); err != nil {
+	defer func() { resp = withRepairs(resp, requestData.PublicRequest) }()
+	padding := options.Padding
+	if requestData.Padding != `` {
+		var err error
+		if padding, err = data.ParsePadding(requestData.Padding); err != nil {
+			return nil, werr(err, 400, `unable to understand padding`)
+		}
+	}
+	publicRequest, description, err := openRecipient(requestData.PublicRequest)
+	if err != nil {
 		return nil, werr(err, 400, `unable to understand public request`)
 	}
+	if _, verr := verifyRequests(publicRequest); verr != nil {
+		return nil, verr
+	}
 	responseEnvelope.Name = `RESPONSE`
-	responseEnvelope.Prelude = publicRequest.Description
+	responseEnvelope.Prelude = description
 
-	if response, err := publicRequest.Encode([]byte(requestData.Data)); err != nil {
+	if len(requestData.Fields) == 0 {
+		plaintext = []byte(requestData.Data)
+	} else if requestData.Data != `` {
+		return nil, werr(errors.New(`both Data and Fields given`), 400, `give either Data or Fields, not both`)
+	} else if plaintext, err = requestData.Fields.MarshalBinary(); err != nil {
+		return nil, werr(err, 400, `unable to encode fields`)
+	} else {
+		content = data.FieldsContent
+	}
+	if requestData.Threshold > 0 {
+		return splitResponse(publicRequest.Requests(), requestData.Threshold, plaintext, content, padding)
+	}
+	response, err := publicRequest.EncodeContent(plaintext, content, padding)
+	if err != nil {
 		return nil, werr(err, 500, `unable to encode response`)
-	} else if err := responseEnvelope.Stuff(response); err != nil {
+	}
+	responseEnvelope.Headers = response.Headers()
+	if err := responseEnvelope.Stuff(response); err != nil {
 		return nil, werr(err, 500, `unable to stuff response envelope`)
 	}
-	return textReaderResponse{responseEnvelope.Reader()}, nil
+	return envelopeResponse{responseEnvelope}, nil
+}
+
+// shareResponse is the response to one member of a split secret.
+type shareResponse struct {
+	Request     uuid.UUID
+	Description string
+	Response    envelope.Envelope
+}
+
+// splitResponse splits the secret among the members, and makes a response
+// holding each member's share.
+func splitResponse(members []data.PublicRequest, threshold int, secret []byte, content data.Content, padding data.Padding) (response, *webError) {
+	shares, err := data.SplitContent(secret, content, len(members), threshold)
+	if err != nil {
+		return nil, werr(err, 400, `unable to split secret`)
+	}
+	responses := make([]shareResponse, len(members))
+	for i, member := range members {
+		plaintext, err := shares[i].MarshalBinary()
+		if err != nil {
+			return nil, werr(err, 500, `unable to encode share`)
+		}
+		response, err := member.EncodeContent(plaintext, data.ShareContent, padding)
+		if err != nil {
+			return nil, werr(err, 500, `unable to encode response`)
+		}
+		responses[i] = shareResponse{
+			Request:     member.ID,
+			Description: member.Description,
+			Response: envelope.Envelope{
+				Name:    `RESPONSE`,
+				Prelude: fmt.Sprintf("%s\n\n%s", member.Description, shares[i].Prelude()),
+				Headers: response.Headers(),
+			},
+		}
+		if err := responses[i].Response.Stuff(response); err != nil {
+			return nil, werr(err, 500, `unable to stuff response envelope`)
+		}
+	}
+	return jsonResponse{struct{ Responses []shareResponse }{responses}}, nil
+}
+
+// openPrivateRequest opens a private request envelope, decrypting it with
+// the passphrase if it is encrypted.
+func openPrivateRequest(env envelope.Envelope, passphrase string) (data.PrivateRequest, *webError) {
+	var privateRequest data.PrivateRequest
+	if env.Name != `ENCRYPTED PRIVATE REQUEST` {
+		if err := env.Open(&privateRequest); err != nil {
+			return privateRequest, werr(err, 400, `unable to open private request envelope`)
+		}
+		return privateRequest, nil
+	}
+	var encrypted data.EncryptedPrivateRequest
+	if err := env.Open(&encrypted); err != nil {
+		return privateRequest, werr(err, 400, `unable to open private request envelope`)
+	}
+	privateRequest, err := encrypted.Decrypt([]byte(passphrase))
+	if errors.Is(err, data.ErrPassphrase) {
+		return privateRequest, werr(err, 403, `wrong passphrase for private request`)
+	} else if err != nil {
+		return privateRequest, werr(err, 400, `unable to decrypt private request`)
+	}
+	return privateRequest, nil
+}
+
+// secretResponse sends a plain secret as text, and a structured secret as
+// JSON.
+func secretResponse(secret []byte, content data.Content) (response, *webError) {
+	if content == data.ShareContent {
+		var share data.Share
+		if err := share.UnmarshalBinary(secret); err != nil {
+			return nil, werr(err, 400, `share is damaged`)
+		}
+		env := envelope.Envelope{Name: `SHARE`}
+		if err := env.Stuff(share); err != nil {
+			return nil, werr(err, 500, `unable to stuff share envelope`)
+		}
+		return jsonResponse{struct {
+			Share     envelope.Envelope
+			Index     int
+			Total     int
+			Threshold int
+		}{env, share.Index, share.Total, share.Threshold}}, nil
+	}
+	if content != data.FieldsContent {
+		return textResponse(secret), nil
+	}
+	var fields data.Fields
+	if err := fields.UnmarshalBinary(secret); err != nil {
+		return nil, werr(err, 500, `unable to decode structured secret`)
+	}
+	return jsonResponse{struct{ Fields data.Fields }{fields}}, nil
+}
+
+// decodeError explains why a response could not be decoded.
+func decodeError(err error) *webError {
+	var mismatch *data.MismatchError
+	switch {
+	case errors.As(err, &mismatch):
+		return werr(err, 409, mismatch.Error())
+	case errors.Is(err, data.ErrCorrupt):
+		return werr(err, 400, `response has been tampered with or is corrupt`)
+	default:
+		return werr(err, 500, `unable to decrypt response`)
+	}
 }
 
-func receive(bodyInto getBody) (response, *webError) {
+// receiveStream decrypts a streamed response. The whole secret is decrypted
+// before anything is sent, so that a damaged stream is reported as an error
+// rather than as a truncated secret.
+func receiveStream(privateRequest data.PrivateRequest, env envelope.Envelope) (response, *webError) {
+	var header data.Response
+	body := env.DataReader()
+	if err := envelope.ReadContent(body, &header); err != nil {
+		return nil, werr(err, 400, `unable to understand open response envelope`)
+	}
+	stream, _, err := privateRequest.DecodeStream(header, body)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	if secret, err := io.ReadAll(stream); err != nil {
+		return nil, decodeError(err)
+	} else {
+		return secretResponse(secret, header.Content)
+	}
+}
+
+func receive(bodyInto getBody) (resp response, verr *webError) {
 	var (
 		requestData struct {
 			PrivateRequest envelope.Envelope
+			Passphrase     string
 			Data           envelope.Envelope
 		}
-		privateRequest data.PrivateRequest
-		response       data.Response
+		response data.Response
 	)
 	if err := bodyInto(&requestData); err != nil {
 		return nil, werr(err, 400, `unable to understand request parameters`)
 	}
-	if err := requestData.PrivateRequest.Open(&privateRequest); err != nil {
-		return nil, werr(err, 400, `unable to open private request envelope`)
+	defer func() { resp = withRepairs(resp, requestData.PrivateRequest, requestData.Data) }()
+	privateRequest, verr := openPrivateRequest(requestData.PrivateRequest, requestData.Passphrase)
+	if verr != nil {
+		return nil, verr
+	}
+	if requestData.Data.Name == `STREAMED RESPONSE` {
+		return receiveStream(privateRequest, requestData.Data)
 	}
 	if err := requestData.Data.Open(&response); err != nil {
 		return nil, werr(err, 400, `unable to understand open response envelope`)
 	} else if secret, err := privateRequest.Decode(response); err != nil {
-		return nil, werr(err, 500, `unable to decrypt response`)
+		return nil, decodeError(err)
 	} else {
-		return textResponse(secret), nil
+		return secretResponse(secret, response.Content)
+	}
+}
+
+// combine rebuilds a split secret from the SHARE envelopes that /receive
+// returned to its requesters.
+func combine(bodyInto getBody) (resp response, verr *webError) {
+	var requestData struct {
+		Shares []envelope.Envelope
+	}
+	if err := bodyInto(&requestData); err != nil {
+		return nil, werr(err, 400, `unable to understand request parameters`)
+	}
+	defer func() { resp = withRepairs(resp, requestData.Shares...) }()
+	shares := make([]data.Share, len(requestData.Shares))
+	for i, env := range requestData.Shares {
+		if env.Name != `SHARE` {
+			return nil, werr(fmt.Errorf(`%s is not a share`, env.Name), 400, `expected SHARE envelopes`)
+		}
+		if err := env.Open(&shares[i]); err != nil {
+			return nil, werr(err, 400, `unable to open share envelope`)
+		}
+	}
+	secret, err := data.Combine(shares)
+	switch {
+	case errors.Is(err, data.ErrMixedShares):
+		return nil, werr(err, 409, `shares belong to different secrets`)
+	case errors.Is(err, data.ErrCorrupt):
+		return nil, werr(err, 400, `a share has been tampered with or is corrupt`)
+	case errors.Is(err, data.ErrTooFewShares):
+		return nil, werr(err, 400, `too few shares to rebuild the secret`)
+	case err != nil:
+		return nil, werr(err, 400, `unable to combine shares`)
 	}
+	return secretResponse(secret, shares[0].Content)
 }
 
 func index(_ getBody) (response, *webError) {
@@ -189,10 +586,14 @@ func index(_ getBody) (response, *webError) {
 // ListenAndServe runs the server. It blocks until the server is shut down.
 // If the server was shut down due to a CTRL+C, null is returned as the error, unlike the underlying
 // http.Server implementation.
-func ListenAndServe(addr string) error {
+func ListenAndServe(addr string, opts Options) error {
+	options = opts
 	http.Handle(`/request`, handlerFunc(request))
+	http.Handle(`/group`, handlerFunc(group))
+	http.Handle(`/verify`, handlerFunc(verify))
 	http.Handle(`/respond`, handlerFunc(respond))
 	http.Handle(`/receive`, handlerFunc(receive))
+	http.Handle(`/combine`, handlerFunc(combine))
 	http.Handle(`/full`, handlerFunc(index))
 	http.Handle(`/`, http.HandlerFunc(short))
 	err := http.ListenAndServe(addr, nil)
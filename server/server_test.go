@@ -8,17 +8,21 @@ import (
 	"encoding/json"
 	"io"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/Unquabain/ephemeral/data"
 	"github.com/Unquabain/ephemeral/envelope"
 	"github.com/tj/assert"
 )
 
 func makeBodyInto[T any](val T) func(any) error {
 	return func(target any) error {
-		tp := target.(*T)
-		*tp = val
-		return nil
+		body, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(body, target)
 	}
 }
 
@@ -109,3 +113,425 @@ greatly curtailed, and by republics, which are governed by chance.
 
 	assert.Equal([]byte(secret), text)
 }
+
+func TestServerGroup(t *testing.T) {
+	var (
+		secret          = `The combination is 12345.`
+		requestResponse [2]struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+		}
+		groupRequest struct {
+			Description    string
+			PublicRequests []envelope.Envelope
+		}
+		groupResponse  envelope.Envelope
+		respondRequest struct {
+			PublicRequest envelope.Envelope
+			Data          string
+		}
+		respondResponse envelope.Envelope
+		receiveRequest  struct {
+			PrivateRequest envelope.Envelope
+			Data           envelope.Envelope
+		}
+		assert = assert.New(t)
+	)
+
+	for i := range requestResponse {
+		r, werr := request(makeBodyInto(struct{ Description string }{`Luggage`}))
+		assert.Nil(werr)
+		assert.NoError(extractJSON(r, &requestResponse[i]))
+		groupRequest.PublicRequests = append(groupRequest.PublicRequests, requestResponse[i].PublicRequest)
+	}
+
+	r, werr := group(makeBodyInto(groupRequest))
+	assert.Nil(werr)
+	assert.NoError(extractEnvelope(r, &groupResponse))
+	assert.Equal(`GROUP REQUEST`, groupResponse.Name)
+
+	respondRequest.PublicRequest = groupResponse
+	respondRequest.Data = secret
+	r, werr = respond(makeBodyInto(respondRequest))
+	assert.Nil(werr)
+	assert.NoError(extractEnvelope(r, &respondResponse))
+
+	for _, member := range requestResponse {
+		receiveRequest.PrivateRequest = member.PrivateRequest
+		receiveRequest.Data = respondResponse
+		r, werr = receive(makeBodyInto(receiveRequest))
+		assert.Nil(werr)
+		text, err := extractBytes(r)
+		assert.NoError(err)
+		assert.Equal([]byte(secret), text)
+	}
+}
+
+func TestServerPassphrase(t *testing.T) {
+	var (
+		requestResponse struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+		}
+		respondResponse envelope.Envelope
+		receiveRequest  struct {
+			PrivateRequest envelope.Envelope
+			Passphrase     string
+			Data           envelope.Envelope
+		}
+		assert = assert.New(t)
+	)
+	r, werr := request(makeBodyInto(struct{ Passphrase string }{`swordfish`}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &requestResponse))
+	assert.Equal(`ENCRYPTED PRIVATE REQUEST`, requestResponse.PrivateRequest.Name)
+
+	r, werr = respond(makeBodyInto(struct {
+		PublicRequest envelope.Envelope
+		Data          string
+	}{requestResponse.PublicRequest, `Open sesame`}))
+	assert.Nil(werr)
+	assert.NoError(extractEnvelope(r, &respondResponse))
+
+	receiveRequest.PrivateRequest = requestResponse.PrivateRequest
+	receiveRequest.Data = respondResponse
+	receiveRequest.Passphrase = `password`
+	_, werr = receive(makeBodyInto(receiveRequest))
+	assert.Equal(403, werr.code)
+
+	receiveRequest.Passphrase = `swordfish`
+	r, werr = receive(makeBodyInto(receiveRequest))
+	assert.Nil(werr)
+	text, err := extractBytes(r)
+	assert.NoError(err)
+	assert.Equal([]byte(`Open sesame`), text)
+}
+
+func TestServerExpired(t *testing.T) {
+	var (
+		requestResponse struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+		}
+		assert = assert.New(t)
+	)
+	// The request expired an hour before it was made, so that the test
+	// does not have to wait for it.
+	r, werr := request(makeBodyInto(struct{ Expires string }{`-1h`}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &requestResponse))
+	assert.Contains(requestResponse.PublicRequest.Prelude, `Expires `)
+
+	_, werr = respond(makeBodyInto(struct {
+		PublicRequest envelope.Envelope
+		Data          string
+	}{requestResponse.PublicRequest, `Too late`}))
+	assert.Equal(410, werr.code)
+}
+
+func TestServerMismatch(t *testing.T) {
+	var (
+		first, second struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+		}
+		respondResponse envelope.Envelope
+		assert          = assert.New(t)
+	)
+	r, werr := request(makeBodyInto(struct{}{}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &first))
+	r, werr = request(makeBodyInto(struct{}{}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &second))
+
+	r, werr = respond(makeBodyInto(struct {
+		PublicRequest envelope.Envelope
+		Data          string
+	}{first.PublicRequest, `Not for you`}))
+	assert.Nil(werr)
+	assert.NoError(extractEnvelope(r, &respondResponse))
+
+	_, werr = receive(makeBodyInto(struct {
+		PrivateRequest envelope.Envelope
+		Data           envelope.Envelope
+	}{second.PrivateRequest, respondResponse}))
+	assert.Equal(409, werr.code)
+	assert.Contains(werr.publicMessage, `this response was made for request`)
+}
+
+func TestServerFields(t *testing.T) {
+	var (
+		requestResponse struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+		}
+		respondResponse envelope.Envelope
+		receiveResponse struct {
+			Fields data.Fields
+		}
+		fields = data.Fields{
+			{Name: `user`, Type: data.TextField, Value: []byte(`admin`)},
+			{Name: `password`, Type: data.SecretField, Value: []byte(`hunter2`)},
+		}
+		assert = assert.New(t)
+	)
+	r, werr := request(makeBodyInto(struct{}{}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &requestResponse))
+
+	r, werr = respond(makeBodyInto(struct {
+		PublicRequest envelope.Envelope
+		Fields        data.Fields
+	}{requestResponse.PublicRequest, fields}))
+	assert.Nil(werr)
+	assert.NoError(extractEnvelope(r, &respondResponse))
+
+	r, werr = receive(makeBodyInto(struct {
+		PrivateRequest envelope.Envelope
+		Data           envelope.Envelope
+	}{requestResponse.PrivateRequest, respondResponse}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &receiveResponse))
+	assert.Equal(fields, receiveResponse.Fields)
+}
+
+func TestServerFingerprint(t *testing.T) {
+	var (
+		requestResponse struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+			Fingerprint    string
+			Code           string
+		}
+		summaries []requestSummary
+		assert    = assert.New(t)
+	)
+	r, werr := request(makeBodyInto(struct{}{}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &requestResponse))
+	assert.NotEmpty(requestResponse.Code)
+	assert.Contains(requestResponse.PublicRequest.Prelude, requestResponse.Code)
+
+	r, werr = verify(makeBodyInto(struct {
+		PublicRequest envelope.Envelope
+	}{requestResponse.PublicRequest}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &summaries))
+	assert.Len(summaries, 1)
+	assert.Equal(requestResponse.Code, summaries[0].Code)
+	assert.Equal(requestResponse.Fingerprint, summaries[0].Fingerprint)
+}
+
+func TestServerPadding(t *testing.T) {
+	var (
+		requestResponse struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+		}
+		respondResponse envelope.Envelope
+		response        data.Response
+		assert          = assert.New(t)
+	)
+	r, werr := request(makeBodyInto(struct{}{}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &requestResponse))
+
+	r, werr = respond(makeBodyInto(struct {
+		PublicRequest envelope.Envelope
+		Data          string
+		Padding       string
+	}{requestResponse.PublicRequest, `Attack at dawn.`, `power2`}))
+	assert.Nil(werr)
+	assert.NoError(extractEnvelope(r, &respondResponse))
+	assert.NoError(respondResponse.Open(&response))
+	assert.True(response.Padded)
+
+	_, werr = respond(makeBodyInto(struct {
+		PublicRequest envelope.Envelope
+		Data          string
+		Padding       string
+	}{requestResponse.PublicRequest, `Attack at dawn.`, `lots`}))
+	assert.NotNil(werr)
+	assert.Equal(400, werr.code)
+}
+
+func TestServerSplit(t *testing.T) {
+	var (
+		secret          = `The launch code is 00000000.`
+		requestResponse [3]struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+		}
+		groupRequest struct {
+			PublicRequests []envelope.Envelope
+		}
+		groupResponse   envelope.Envelope
+		respondResponse struct {
+			Responses []struct {
+				Request  string
+				Response envelope.Envelope
+			}
+		}
+		receiveResponse struct {
+			Share     envelope.Envelope
+			Threshold int
+		}
+		shares []envelope.Envelope
+		assert = assert.New(t)
+	)
+	for i := range requestResponse {
+		r, werr := request(makeBodyInto(struct{}{}))
+		assert.Nil(werr)
+		assert.NoError(extractJSON(r, &requestResponse[i]))
+		groupRequest.PublicRequests = append(groupRequest.PublicRequests, requestResponse[i].PublicRequest)
+	}
+	r, werr := group(makeBodyInto(groupRequest))
+	assert.Nil(werr)
+	assert.NoError(extractEnvelope(r, &groupResponse))
+
+	r, werr = respond(makeBodyInto(struct {
+		PublicRequest envelope.Envelope
+		Data          string
+		Threshold     int
+	}{groupResponse, secret, 2}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &respondResponse))
+	assert.Len(respondResponse.Responses, 3)
+
+	for i, member := range requestResponse[:2] {
+		r, werr = receive(makeBodyInto(struct {
+			PrivateRequest envelope.Envelope
+			Data           envelope.Envelope
+		}{member.PrivateRequest, respondResponse.Responses[i].Response}))
+		assert.Nil(werr)
+		assert.NoError(extractJSON(r, &receiveResponse))
+		assert.Equal(`SHARE`, receiveResponse.Share.Name)
+		assert.Equal(2, receiveResponse.Threshold)
+		shares = append(shares, receiveResponse.Share)
+	}
+
+	_, werr = combine(makeBodyInto(struct{ Shares []envelope.Envelope }{shares[:1]}))
+	assert.NotNil(werr)
+	assert.Equal(400, werr.code)
+	assert.Equal(`too few shares to rebuild the secret`, werr.publicMessage)
+
+	r, werr = combine(makeBodyInto(struct{ Shares []envelope.Envelope }{shares}))
+	assert.Nil(werr)
+	text, err := extractBytes(r)
+	assert.NoError(err)
+	assert.Equal([]byte(secret), text)
+}
+
+func TestServerRepairs(t *testing.T) {
+	var (
+		requestResponse struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+		}
+		summaries []requestSummary
+		assert    = assert.New(t)
+	)
+	r, werr := request(makeBodyInto(struct{}{}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &requestResponse))
+
+	// The public request comes back from a mail program quoted.
+	text, err := requestResponse.PublicRequest.MarshalText()
+	assert.NoError(err)
+	quoted := "> " + strings.ReplaceAll(strings.TrimSpace(string(text)), "\n", "\r\n> ")
+	r, werr = verify(makeBodyInto(struct {
+		PublicRequest string
+	}{quoted}))
+	assert.Nil(werr)
+	recorder := httptest.NewRecorder()
+	assert.NoError(r.Respond(recorder))
+	assert.Equal([]string{`converted Windows line endings`, `removed > quote marks`}, recorder.Result().Header.Values(`Repairs`))
+	assert.NoError(json.NewDecoder(recorder.Result().Body).Decode(&summaries))
+	assert.Len(summaries, 1)
+
+	// A clean one has no repairs to report.
+	r, werr = verify(makeBodyInto(struct {
+		PublicRequest envelope.Envelope
+	}{requestResponse.PublicRequest}))
+	assert.Nil(werr)
+	recorder = httptest.NewRecorder()
+	assert.NoError(r.Respond(recorder))
+	assert.Empty(recorder.Result().Header.Values(`Repairs`))
+}
+
+func TestServerCompact(t *testing.T) {
+	var (
+		secret          = `compact`
+		requestResponse struct {
+			PrivateRequest envelope.Envelope
+			PublicRequest  envelope.Envelope
+		}
+		respondResponse envelope.Envelope
+		assert          = assert.New(t)
+	)
+	r, werr := request(makeBodyInto(struct{}{}))
+	assert.Nil(werr)
+	assert.NoError(extractJSON(r, &requestResponse))
+
+	// Compact envelopes are accepted wherever armored ones are.
+	public, err := requestResponse.PublicRequest.Bech32()
+	assert.NoError(err)
+	r, werr = respond(makeBodyInto(struct {
+		PublicRequest string
+		Data          string
+	}{public, secret}))
+	assert.Nil(werr)
+	assert.NoError(extractEnvelope(r, &respondResponse))
+
+	private, err := requestResponse.PrivateRequest.Base64URL()
+	assert.NoError(err)
+	response, err := respondResponse.Bech32()
+	assert.NoError(err)
+	r, werr = receive(makeBodyInto(struct {
+		PrivateRequest string
+		Data           string
+	}{private, response}))
+	assert.Nil(werr)
+	text, err := extractBytes(r)
+	assert.NoError(err)
+	assert.Equal([]byte(secret), text)
+
+	// The short flow takes a compact public request in place of a key.
+	recorder := httptest.NewRecorder()
+	shortRespondPost(recorder, httptest.NewRequest(`POST`, `/`, nil), map[string]string{`public`: public, `data`: secret})
+	assert.Equal(200, recorder.Code)
+	var shortResponse envelope.Envelope
+	_, err = shortResponse.ReadFrom(recorder.Result().Body)
+	assert.NoError(err)
+	assert.Equal(`RESPONSE`, shortResponse.Name)
+
+	// A signed request shows its signer, as it does in the full flow, and
+	// one whose signature does not match is refused.
+	identity, err := data.NewIdentity(`Alice`)
+	assert.NoError(err)
+	signed, err := data.NewRequest(``)
+	assert.NoError(err)
+	signedPublic := signed.Public()
+	assert.NoError(signedPublic.Sign(identity))
+	for _, c := range []struct {
+		name    string
+		tamper  func(*data.PublicRequest)
+		message string
+	}{
+		{`signed`, func(*data.PublicRequest) {}, `This request was signed by <strong>Alice (ed25519:`},
+		{`forged`, func(p *data.PublicRequest) { p.Description = `Forged` }, `the signature on this request is not valid`},
+	} {
+		request := signedPublic
+		c.tamper(&request)
+		env := envelope.Envelope{Name: `PUBLIC REQUEST`}
+		assert.NoError(env.Stuff(request))
+		compact, err := env.Bech32()
+		assert.NoError(err)
+		recorder := httptest.NewRecorder()
+		shortRespondGet(recorder, httptest.NewRequest(`GET`, `/`, nil), map[string]string{`public`: compact})
+		body, err := io.ReadAll(recorder.Result().Body)
+		assert.NoError(err)
+		assert.Contains(string(body), c.message, c.name)
+	}
+}
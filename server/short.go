@@ -1,13 +1,18 @@
 package server
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"html/template"
-	"io"
 	"net/http"
 
 	// embed needs to be imported to enable the go:embed special compiler comment.
 	_ "embed"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Unquabain/ephemeral/data"
 	"github.com/Unquabain/ephemeral/envelope"
@@ -25,6 +30,9 @@ var shortRespondHTML string
 //go:embed error.html
 var errorHTML string
 
+//go:embed shortSecret.html
+var shortSecretHTML string
+
 const (
 	requestPhase shortPhase = iota
 	respondGetPhase
@@ -36,17 +44,18 @@ func detectPhase(r *http.Request) (shortPhase, map[string]string) {
 	public := r.FormValue(`public`)
 	private := r.FormValue(`private`)
 	data := r.FormValue(`data`)
+	expires := r.FormValue(`expires`)
 	if r.Method == http.MethodGet {
 		if public == `` {
 			return requestPhase, nil
 		}
-		return respondGetPhase, map[string]string{`public`: public}
+		return respondGetPhase, map[string]string{`public`: public, `expires`: expires}
 	}
-	if public != `` && data != `` {
-		return respondPostPhase, map[string]string{`public`: public, `data`: data}
+	if public != `` && (data != `` || r.FormValue(`field-name`) != ``) {
+		return respondPostPhase, map[string]string{`public`: public, `data`: data, `expires`: expires}
 	}
 	if private != `` && data != `` {
-		return receivePhase, map[string]string{`private`: private, `data`: data}
+		return receivePhase, map[string]string{`private`: private, `data`: data, `expires`: expires}
 	}
 	return requestPhase, nil
 }
@@ -63,6 +72,19 @@ func shortError(w http.ResponseWriter, r *http.Request, err error, msg string) {
 	}
 }
 
+// parseExpires reads the expiry time of a short flow request, which travels
+// as seconds since the epoch. An empty value means it never expires.
+func parseExpires(value string) (time.Time, error) {
+	if value == `` {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
 func returnURL(request *http.Request) string {
 	var ret url.URL
 	ret.Scheme = `https`
@@ -82,12 +104,18 @@ func returnURL(request *http.Request) string {
 
 func shortRequest(w http.ResponseWriter, r *http.Request) {
 	var tctx struct {
-		Public, Private, URL string
+		Public, Private, URL, Expires, Code string
 	}
 	tctx.URL = returnURL(r)
+	if options.ShortExpiry != 0 {
+		tctx.Expires = strconv.FormatInt(time.Now().Add(options.ShortExpiry).Unix(), 10)
+	}
 	if private, err := data.NewPrivateKey(data.RandomCurve()); err != nil {
 		shortError(w, r, err, `could not create private key`)
 		return
+	} else if fingerprint, err := (data.PublicRequest{Key: private.Public()}).Fingerprint(); err != nil {
+		shortError(w, r, err, `could not fingerprint public key`)
+		return
 	} else if public, err := private.Public().MarshalText(); err != nil {
 		shortError(w, r, err, `could not marshal public key`)
 		return
@@ -98,6 +126,7 @@ func shortRequest(w http.ResponseWriter, r *http.Request) {
 		shortError(w, r, err, `could not parse template`)
 		return
 	} else {
+		tctx.Code = fingerprint.Code()
 		tctx.Public = string(public)
 		tctx.Private = string(private)
 		if err := tmplt.Execute(w, tctx); err != nil {
@@ -106,7 +135,70 @@ func shortRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// shortPublic reads the public request of the short flow: a public key,
+// with the expiry time given separately, or a whole public request in one
+// of the compact forms of an envelope, such as ephpub1.... A whole request
+// may be signed, in which case the signature is checked, and the signer is
+// returned, as it is by /respond.
+func shortPublic(dict map[string]string) (data.PublicRequest, *data.Signer, error) {
+	var request data.PublicRequest
+	if strings.HasPrefix(strings.ToLower(dict[`public`]), `eph`) {
+		var env envelope.Envelope
+		if err := env.UnmarshalText([]byte(dict[`public`])); err != nil {
+			return request, nil, err
+		} else if env.Name != `PUBLIC REQUEST` {
+			return request, nil, fmt.Errorf(`%s is not a public request`, env.Name)
+		} else if err := env.Open(&request); err != nil {
+			return request, nil, err
+		}
+		signer, err := request.Verify()
+		if err != nil {
+			return request, nil, fmt.Errorf(`%w: %w`, errShortSignature, err)
+		}
+		return request, signer, nil
+	}
+	if err := request.Key.UnmarshalText([]byte(dict[`public`])); err != nil {
+		return request, nil, err
+	}
+	expires, err := parseExpires(dict[`expires`])
+	if err != nil {
+		return request, nil, fmt.Errorf(`could not understand expiry time: %w`, err)
+	}
+	request.Expires = expires
+	return request, nil, nil
+}
+
+// errShortSignature is returned by shortPublic when a public request's
+// signature does not match it.
+var errShortSignature = errors.New(`request signature is not valid`)
+
+// shortPublicError explains why the public request of the short flow could
+// not be read.
+func shortPublicError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errShortSignature) {
+		shortError(w, r, err, `the signature on this request is not valid; do not respond to it`)
+	} else {
+		shortError(w, r, err, `could not parse public request`)
+	}
+}
+
 func shortRespondGet(w http.ResponseWriter, r *http.Request, dict map[string]string) {
+	request, signer, err := shortPublic(dict)
+	if err != nil {
+		shortPublicError(w, r, err)
+		return
+	} else if request.Expired(time.Now()) {
+		shortError(w, r, nil, `this request has expired; ask for a new one`)
+		return
+	} else if fingerprint, err := request.Fingerprint(); err != nil {
+		shortError(w, r, err, `could not fingerprint public key`)
+		return
+	} else {
+		dict[`code`] = fingerprint.Code()
+	}
+	if signer != nil {
+		dict[`signer`] = signer.String()
+	}
 	if t, err := template.New(`respond`).Parse(shortRespondHTML); err != nil {
 		shortError(w, r, err, `could not parse template`)
 		return
@@ -116,25 +208,45 @@ func shortRespondGet(w http.ResponseWriter, r *http.Request, dict map[string]str
 }
 
 func shortRespondPost(w http.ResponseWriter, r *http.Request, dict map[string]string) {
-	var request data.PublicRequest
 	var env envelope.Envelope
-	if err := request.Key.UnmarshalText([]byte(dict[`public`])); err != nil {
-		shortError(w, r, err, `could not parse public key`)
+	request, _, err := shortPublic(dict)
+	if err != nil {
+		shortPublicError(w, r, err)
+		return
+	}
+	if request.Expired(time.Now()) {
+		shortError(w, r, nil, `this request has expired; ask for a new one`)
+		return
+	}
+	plaintext, content := []byte(dict[`data`]), data.RawContent
+	if fields, err := shortFields(r); err != nil {
+		shortError(w, r, err, `could not understand fields`)
 		return
+	} else if len(fields) > 0 {
+		if dict[`data`] != `` {
+			shortError(w, r, nil, `give either data or fields, not both`)
+			return
+		}
+		if plaintext, err = fields.MarshalBinary(); err != nil {
+			shortError(w, r, err, `could not encode fields`)
+			return
+		}
+		content = data.FieldsContent
 	}
-	response, err := request.Encode([]byte(dict[`data`]))
+	response, err := request.EncodeContent(plaintext, content, options.Padding)
 	if err != nil {
 		shortError(w, r, err, `could not encode data`)
 		return
 	}
 	env.Prelude = `Send this back to the person who sent you this link.`
 	env.Name = `RESPONSE`
+	env.Headers = response.Headers()
 	if err := env.Stuff(response); err != nil {
 		shortError(w, r, err, `could not stuff response envelope`)
 		return
 	}
 	w.Header().Add(`Content-Type`, `text/plain`)
-	if _, err := io.Copy(w, env.Reader()); err != nil {
+	if _, err := env.WriteTo(w); err != nil {
 		shortError(w, r, err, `could not write envelope`)
 		return
 	}
@@ -147,11 +259,20 @@ func shortReceive(w http.ResponseWriter, r *http.Request, dict map[string]string
 		shortError(w, r, err, `could not parse private key`)
 		return
 	}
+	if expires, err := parseExpires(dict[`expires`]); err != nil {
+		shortError(w, r, err, `could not understand expiry time`)
+		return
+	} else {
+		request.Expires = expires
+	}
 
 	if err := env.UnmarshalText([]byte(dict[`data`])); err != nil {
 		shortError(w, r, err, `could not read envelope`)
 		return
 	}
+	for _, repair := range env.Repairs {
+		w.Header().Add(`Repairs`, repair)
+	}
 
 	err := env.Open(&response)
 	if err != nil {
@@ -165,6 +286,11 @@ func shortReceive(w http.ResponseWriter, r *http.Request, dict map[string]string
 		return
 	}
 
+	if response.Content == data.FieldsContent {
+		shortSecret(w, r, secret)
+		return
+	}
+
 	w.Header().Add(`Content-Type`, `text/plain`)
 	w.Header().Add(`Content-Disposition`, `attachment; filename="secret.txt"`)
 	if _, err := w.Write(secret); err != nil {
@@ -172,6 +298,54 @@ func shortReceive(w http.ResponseWriter, r *http.Request, dict map[string]string
 		return
 	}
 }
+
+// shortFields reads the fields of a structured secret from the respond
+// form. Rows with no name are ignored.
+func shortFields(r *http.Request) (data.Fields, error) {
+	var (
+		fields data.Fields
+		names  = r.Form[`field-name`]
+		types  = r.Form[`field-type`]
+		values = r.Form[`field-value`]
+	)
+	if len(types) != len(names) || len(values) != len(names) {
+		return nil, fmt.Errorf(`fields are incomplete`)
+	}
+	for i, name := range names {
+		if name == `` {
+			continue
+		}
+		t, err := data.ParseFieldType(types[i])
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, data.Field{Name: name, Type: t, Value: []byte(values[i])})
+	}
+	return fields, nil
+}
+
+// shortSecret shows a structured secret as a table.
+func shortSecret(w http.ResponseWriter, r *http.Request, secret []byte) {
+	var fields data.Fields
+	if err := fields.UnmarshalBinary(secret); err != nil {
+		shortError(w, r, err, `could not decode structured secret`)
+		return
+	}
+	tmplt, err := template.New(`secret`).Funcs(template.FuncMap{
+		`dataURL`: func(b []byte) template.URL {
+			return template.URL(`data:application/octet-stream;base64,` + base64.StdEncoding.EncodeToString(b))
+		},
+	}).Parse(shortSecretHTML)
+	if err != nil {
+		shortError(w, r, err, `could not parse template`)
+		return
+	}
+	w.Header().Add(`Content-Type`, `text/html`)
+	if err := tmplt.Execute(w, struct{ Fields data.Fields }{fields}); err != nil {
+		log.WithError(err).Error(`could not render secret`)
+	}
+}
+
 func short(w http.ResponseWriter, r *http.Request) {
 	phase, dict := detectPhase(r)
 	switch phase {
@@ -0,0 +1,93 @@
+/*
+Package wire encodes the contents of envelopes in a versioned format that
+does not depend on Go. Content is CBOR (RFC 8949), with small integer keys
+for struct fields, wrapped in a frame that gives its version. The format is
+specified in doc/wire-format.markdown.
+
+Content written with encoding/gob, as it was before this format, can still
+be decoded.
+*/
+package wire
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Version is the version of the format that Marshal writes.
+const Version = 1
+
+// magic is CBOR's self-describe tag, 55799. It begins every frame, and it
+// can never begin a gob stream, so old content can be told apart.
+var magic = []byte{0xd9, 0xd9, 0xf7}
+
+// frame is what follows the magic: an array of the version and the content.
+type frame struct {
+	_       struct{} `cbor:",toarray"`
+	Version uint
+	Content cbor.RawMessage
+}
+
+var (
+	encMode cbor.EncMode
+	decMode cbor.DecMode
+)
+
+func init() {
+	var err error
+	if encMode, err = (cbor.EncOptions{
+		Sort: cbor.SortCoreDeterministic,
+		Time: cbor.TimeUnix,
+	}).EncMode(); err != nil {
+		panic(err)
+	}
+	if decMode, err = (cbor.DecOptions{
+		DupMapKey: cbor.DupMapKeyEnforcedAPF,
+	}).DecMode(); err != nil {
+		panic(err)
+	}
+}
+
+// Marshal encodes v in the current version of the format.
+func Marshal(v any) ([]byte, error) {
+	content, err := encMode.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf(`could not encode content: %w`, err)
+	}
+	b, err := encMode.Marshal(frame{Version: Version, Content: content})
+	if err != nil {
+		return nil, fmt.Errorf(`could not encode frame: %w`, err)
+	}
+	return append(bytes.Clone(magic), b...), nil
+}
+
+// Unmarshal decodes b into v, which must be a pointer. Content in any
+// version of the format up to Version, or in gob, is understood.
+func Unmarshal(b []byte, v any) error {
+	if IsGob(b) {
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(v); err != nil {
+			return fmt.Errorf(`could not decode gob content: %w`, err)
+		}
+		return nil
+	}
+	var f frame
+	if err := decMode.Unmarshal(b[len(magic):], &f); err != nil {
+		return fmt.Errorf(`could not decode frame: %w`, err)
+	}
+	if f.Version == 0 || f.Version > Version {
+		return fmt.Errorf(`content is in version %d of the wire format, but only versions 1 to %d are understood`, f.Version, Version)
+	}
+	if err := decMode.Unmarshal(f.Content, v); err != nil {
+		return fmt.Errorf(`could not decode content: %w`, err)
+	}
+	return nil
+}
+
+// IsGob reports whether b was written with encoding/gob, rather than in
+// this format.
+func IsGob(b []byte) bool {
+	return !bytes.HasPrefix(b, magic)
+}
@@ -0,0 +1,55 @@
+package wire_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/Unquabain/ephemeral/wire"
+	"github.com/stretchr/testify/assert"
+)
+
+type sample struct {
+	Name    string    `cbor:"1,keyasint"`
+	Data    []byte    `cbor:"2,keyasint,omitempty"`
+	Expires time.Time `cbor:"3,keyasint,omitzero"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	in := sample{Name: `a`, Data: []byte{1, 2}, Expires: time.Unix(1700000000, 0)}
+	b, err := wire.Marshal(in)
+	assert.NoError(err)
+	assert.False(wire.IsGob(b))
+	var out sample
+	assert.NoError(wire.Unmarshal(b, &out))
+	assert.Equal(in, out)
+}
+
+// TestSpecExample checks the example in doc/wire-format.markdown.
+func TestSpecExample(t *testing.T) {
+	assert := assert.New(t)
+	b, err := wire.Marshal(sample{Name: `a`, Data: []byte{1, 2}})
+	assert.NoError(err)
+	assert.Equal(`d9d9f78201a201616102420102`, hex.EncodeToString(b))
+}
+
+func TestGob(t *testing.T) {
+	assert := assert.New(t)
+	in := sample{Name: `a`, Data: []byte{1, 2}}
+	buff := new(bytes.Buffer)
+	assert.NoError(gob.NewEncoder(buff).Encode(in))
+	assert.True(wire.IsGob(buff.Bytes()))
+	var out sample
+	assert.NoError(wire.Unmarshal(buff.Bytes(), &out))
+	assert.Equal(in, out)
+}
+
+func TestFutureVersion(t *testing.T) {
+	future, err := hex.DecodeString(`d9d9f78202a201616102420102`)
+	assert.NoError(t, err)
+	var out sample
+	assert.ErrorContains(t, wire.Unmarshal(future, &out), `version 2`)
+}